@@ -0,0 +1,296 @@
+package pdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Настройки отправки алертов в Alertmanager (/api/v2/alerts)
+// URLs - адреса alertmanager, алерты отправляются в каждый (кластер alertmanager)
+// ResendInterval - период повторной отправки активных алертов в секундах, Labels - лейблы, добавляемые ко всем алертам
+type AlertmanagerSettings struct {
+	URLs           []string          `json:"urls" validate:"dive,url"`
+	ResendInterval int               `json:"resendInterval" validate:"gte=0"`
+	Labels         map[string]string `json:"labels"`
+	SinkHttpSettings
+}
+
+// период повторной отправки по умолчанию, в секундах
+const defaultAlertResendInterval = 60
+
+// Имена алертов
+const (
+	alertGroupDegraded = "DnsAuthGroupDegraded"
+	alertGroupDown     = "DnsAuthGroupDown"
+	alertRecursorDown  = "DnsRecursorDown"
+)
+
+// Алерт в формате api v2 alertmanager
+type postableAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// Метрики отправки алертов
+var (
+	alertmanagerPosts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alertmanager_posts_total",
+			Help: "Количество отправок алертов в alertmanager по адресу и результату",
+		},
+		[]string{"url", "result"},
+	)
+	alertmanagerActiveAlerts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "alertmanager_active_alerts",
+			Help: "Количество активных алертов, отправляемых в alertmanager",
+		},
+	)
+)
+
+// Отправитель алертов, получает результаты каждого цикла опроса
+// active - активные алерты по ключу из лейблов, resolved - завершенные алерты, еще не доставленные в alertmanager
+// pending - есть изменения, которые еще не доставлены
+type alertmanagerSink struct {
+	settings  AlertmanagerSettings
+	client    *sinkHttpClient
+	resend    time.Duration
+	groups    map[string]AuthCluster
+	recursors map[string]RecursorServer
+	updates   chan []postableAlert
+	active    map[string]postableAlert
+	resolved  map[string]postableAlert
+	pending   bool
+	lastSent  time.Time
+}
+
+// Функция создает отправителя алертов и запускает отправку
+func newAlertmanagerSink(conf *Conf, reloadInterval time.Duration) (*alertmanagerSink, error) {
+	client, err := newSinkHttpClient("alertmanager", conf.Alertmanager.SinkHttpSettings, reloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	resend := conf.Alertmanager.ResendInterval
+	if resend == 0 {
+		resend = defaultAlertResendInterval
+	}
+	sink := &alertmanagerSink{
+		settings:  conf.Alertmanager,
+		client:    client,
+		resend:    time.Duration(resend) * time.Second,
+		groups:    make(map[string]AuthCluster),
+		recursors: make(map[string]RecursorServer),
+		updates:   make(chan []postableAlert, 1),
+		active:    make(map[string]postableAlert),
+		resolved:  make(map[string]postableAlert),
+	}
+	for _, megacluster := range conf.AuthClusters {
+		sink.groups[megacluster.MegaClusterID] = megacluster
+	}
+	for _, recursor := range conf.RecursorServers {
+		sink.recursors[recursor.RecursorID] = recursor
+	}
+	go sink.run()
+	return sink, nil
+}
+
+// Функция передает отправке алерты, активные по результатам цикла, неотправленный предыдущий набор заменяется
+func (sink *alertmanagerSink) HandleCycle(snapshot ProbeSnapshot) {
+	alerts := sink.alerts(snapshot)
+	select {
+	case <-sink.updates:
+	default:
+	}
+	sink.updates <- alerts
+}
+
+// Функция возвращает алерты по результатам цикла: деградация или недоступность группы (кластеры на обслуживании не учитываются)
+// и недоступность рекурсора
+func (sink *alertmanagerSink) alerts(snapshot ProbeSnapshot) []postableAlert {
+	var alerts []postableAlert
+	for _, megacluster := range snapshot.Megaclusters {
+		verdict := megaclusterVerdict(megacluster)
+		if verdict != verdictDegraded && verdict != verdictDown {
+			continue
+		}
+		group := sink.groups[megacluster.MegaClusterID]
+		alert := postableAlert{
+			Labels: map[string]string{"alertname": alertGroupDegraded, "severity": severityWarning},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("The group %s is degraded: %d of %d clusters are available",
+					megacluster.MegaClusterID, megacluster.AvailabileSimpleClusters, megacluster.AllSimpleClusters-megacluster.MaintenanceSimpleClusters),
+			},
+		}
+		if verdict == verdictDown {
+			alert.Labels = map[string]string{"alertname": alertGroupDown, "severity": severityCritical}
+			alert.Annotations["summary"] = fmt.Sprintf("All clusters of the group %s are unavailable", megacluster.MegaClusterID)
+		}
+		alert.Labels[tenantClusterLabel] = megacluster.MegaClusterID
+		if group.Description != "" {
+			alert.Annotations["description"] = group.Description
+		}
+		alert.Annotations["unavailable_clusters"] = unavailableClusters(megacluster, group)
+		alerts = append(alerts, sink.withLabels(alert, group.Labels))
+	}
+	for _, recursor := range snapshot.Recursors {
+		if recursor.Availability {
+			continue
+		}
+		server := sink.recursors[recursor.RecursorID]
+		alert := postableAlert{
+			Labels: map[string]string{
+				"alertname":         alertRecursorDown,
+				"severity":          severityCritical,
+				tenantRecursorLabel: recursor.RecursorID,
+				"family":            recursor.Family,
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("The recursor %s (%s) is unavailable", recursor.RecursorID, recursor.Family),
+			},
+		}
+		if server.Description != "" {
+			alert.Annotations["description"] = server.Description
+		}
+		if state, found := targetStates.Get(recursorStateKey(recursor.RecursorID, recursor.Family)); found && state.LastFailure != "" {
+			alert.Annotations["last_failure"] = state.LastFailure
+		}
+		alerts = append(alerts, sink.withLabels(alert, server.Labels))
+	}
+	return alerts
+}
+
+// Функция возвращает недоступные кластеры группы с описанием и причиной последней неудачной проверки
+func unavailableClusters(megacluster AvailabilityMegacluster, group AuthCluster) string {
+	descriptions := make(map[string]string)
+	for _, simplecluster := range group.SimpleClusters {
+		descriptions[simplecluster.ClusterID] = simplecluster.Description
+	}
+	var clusters []string
+	for _, cluster := range megacluster.SimpleClusters {
+		if cluster.Availability || cluster.Maintenance {
+			continue
+		}
+		line := cluster.ClusterID
+		if descriptions[cluster.ClusterID] != "" {
+			line += fmt.Sprintf(" (%s)", descriptions[cluster.ClusterID])
+		}
+		state, found := targetStates.Get(simpleClusterStateKey(megacluster.MegaClusterID, cluster.ClusterID))
+		if found && state.LastFailure != "" {
+			line += ": " + state.LastFailure
+		}
+		clusters = append(clusters, line)
+	}
+	sort.Strings(clusters)
+	return strings.Join(clusters, "; ")
+}
+
+// Функция добавляет к алерту лейблы группы или рекурсора из конфига и общие лейблы из настроек alertmanager
+// лейблы алерта имеют приоритет над лейблами из конфига
+func (sink *alertmanagerSink) withLabels(alert postableAlert, labels map[string]string) postableAlert {
+	for _, extra := range []map[string]string{labels, sink.settings.Labels} {
+		for name, value := range extra {
+			if _, ok := alert.Labels[name]; !ok {
+				alert.Labels[name] = value
+			}
+		}
+	}
+	return alert
+}
+
+// Функция возвращает ключ алерта из отсортированных лейблов
+func alertKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Функция отправляет алерты: новые и завершенные - сразу, активные - повторно раз в resendInterval
+// endsAt активного алерта - через 4 периода отправки, чтобы alertmanager завершил алерт, если экспортер остановлен
+func (sink *alertmanagerSink) run() {
+	for firing := range sink.updates {
+		now := time.Now()
+		changed := false
+		current := make(map[string]bool)
+		for _, alert := range firing {
+			key := alertKey(alert.Labels)
+			current[key] = true
+			if previous, ok := sink.active[key]; ok {
+				alert.StartsAt = previous.StartsAt
+			} else {
+				alert.StartsAt = now
+				changed = true
+				slog.Info(fmt.Sprintf("The alert %s is firing: %s", alert.Labels["alertname"], alert.Annotations["summary"]))
+			}
+			sink.active[key] = alert
+			delete(sink.resolved, key)
+		}
+		for key, alert := range sink.active {
+			if !current[key] {
+				alert.EndsAt = now
+				sink.resolved[key] = alert
+				delete(sink.active, key)
+				changed = true
+				slog.Info(fmt.Sprintf("The alert %s is resolved: %s", alert.Labels["alertname"], alert.Annotations["summary"]))
+			}
+		}
+		alertmanagerActiveAlerts.Set(float64(len(sink.active)))
+		sink.pending = sink.pending || changed
+		if !sink.pending && now.Sub(sink.lastSent) < sink.resend {
+			continue
+		}
+		var batch []postableAlert
+		for _, alert := range sink.active {
+			alert.EndsAt = now.Add(4 * sink.resend)
+			batch = append(batch, alert)
+		}
+		for _, alert := range sink.resolved {
+			batch = append(batch, alert)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if sink.post(batch) {
+			sink.lastSent = now
+			sink.pending = false
+			sink.resolved = make(map[string]postableAlert)
+		}
+	}
+}
+
+// Функция отправляет алерты в каждый alertmanager, true - хотя бы один принял алерты
+// при ошибке отправка повторится после следующего цикла опроса
+func (sink *alertmanagerSink) post(alerts []postableAlert) bool {
+	payload, err := json.Marshal(alerts)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error encoding alerts: %s", err))
+		return false
+	}
+	delivered := false
+	for _, address := range sink.settings.URLs {
+		err := sink.client.do("POST", strings.TrimRight(address, "/")+"/api/v2/alerts", "application/json", payload, nil)
+		if err != nil {
+			alertmanagerPosts.WithLabelValues(address, "failure").Inc()
+			slog.Error(fmt.Sprintf("Error sending alerts to %s: %s", address, err))
+			continue
+		}
+		alertmanagerPosts.WithLabelValues(address, "success").Inc()
+		delivered = true
+	}
+	return delivered
+}
+
+// Функция возвращает метрики отправки алертов для регистрации
+func alertmanagerCollectors() []prometheus.Collector {
+	return []prometheus.Collector{alertmanagerPosts, alertmanagerActiveAlerts}
+}
@@ -0,0 +1,232 @@
+package pdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Метрики перезагрузки сертификатов, лейбл source - exporter (страница экспортера) или requests (запросы к апи)
+var (
+	certReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tls_cert_reloads_total",
+			Help: "Количество попыток перезагрузки сертификатов по результату",
+		},
+		[]string{"source", "result"},
+	)
+	certLastReloadSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_cert_last_reload_success",
+			Help: "Результат последней перезагрузки сертификатов (1 - успешно)",
+		},
+		[]string{"source"},
+	)
+	certNotAfter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_cert_not_after_timestamp_seconds",
+			Help: "Время окончания действия текущего сертификата в unix секундах",
+		},
+		[]string{"source"},
+	)
+	certDaysRemainingDesc = prometheus.NewDesc(
+		"tls_cert_days_remaining",
+		"Количество дней до окончания действия текущего сертификата",
+		[]string{"source"},
+		prometheus.Labels{},
+	)
+	certInfoDesc = prometheus.NewDesc(
+		"tls_cert_info",
+		"Субъект и издатель текущего сертификата, значение всегда 1",
+		[]string{"source", "subject", "issuer"},
+		prometheus.Labels{},
+	)
+)
+
+// Все созданные CertReloader, по ним отдаются метрики срока действия сертификатов экспортера и клиентских сертификатов
+var (
+	reloadersMu sync.Mutex
+	reloaders   []*CertReloader
+)
+
+// Перезагружаемые сертификат, ключ и пул ca
+// файлы проверяются по времени изменения, при ошибке загрузки остаются предыдущие сертификат и пул
+type CertReloader struct {
+	source   string
+	certPath string
+	keyPath  string
+	caPath   string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// Функция создает CertReloader и загружает файлы, caPath может быть пустым
+func NewCertReloader(source, certPath, keyPath, caPath string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		source:   source,
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	reloadersMu.Lock()
+	reloaders = append(reloaders, reloader)
+	reloadersMu.Unlock()
+	return reloader, nil
+}
+
+// Функция возвращает время изменения отслеживаемых файлов
+func (reloader *CertReloader) readModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{reloader.certPath, reloader.keyPath, reloader.caPath} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Функция загружает сертификат, ключ и пул ca и обновляет метрики
+func (reloader *CertReloader) reload() error {
+	err := reloader.load()
+	if err != nil {
+		certReloadsTotal.WithLabelValues(reloader.source, "failure").Inc()
+		certLastReloadSuccess.WithLabelValues(reloader.source).Set(0)
+		return fmt.Errorf("reload %s certificates: %w", reloader.source, err)
+	}
+	certReloadsTotal.WithLabelValues(reloader.source, "success").Inc()
+	certLastReloadSuccess.WithLabelValues(reloader.source).Set(1)
+	return nil
+}
+
+func (reloader *CertReloader) load() error {
+	modTimes, err := reloader.readModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	var caPool *x509.CertPool
+	if reloader.caPath != "" {
+		caCert, err := os.ReadFile(reloader.caPath)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in %s", reloader.caPath)
+		}
+	}
+	reloader.mu.Lock()
+	reloader.cert = &cert
+	reloader.caPool = caPool
+	reloader.modTimes = modTimes
+	reloader.mu.Unlock()
+	certNotAfter.WithLabelValues(reloader.source).Set(float64(leaf.NotAfter.Unix()))
+	slog.Info(fmt.Sprintf("The %s certificate has been loaded, expires at %s", reloader.source, leaf.NotAfter))
+	return nil
+}
+
+// Функция проверяет файлы с заданным интервалом и перезагружает их при изменении
+func (reloader *CertReloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		modTimes, err := reloader.readModTimes()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error checking %s certificates: %s", reloader.source, err))
+			continue
+		}
+		if !reloader.changed(modTimes) {
+			continue
+		}
+		if err := reloader.reload(); err != nil { // время изменения не сохраняется, попытка повторится на следующем тике
+			slog.Error(err.Error())
+		}
+	}
+}
+
+// Функция сравнивает время изменения файлов с загруженными
+func (reloader *CertReloader) changed(modTimes map[string]time.Time) bool {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	for path, modTime := range modTimes {
+		if !reloader.modTimes[path].Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция для tls.Config.GetCertificate сервера экспортера
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert, nil
+}
+
+// Функция для tls.Config.GetClientCertificate клиента запросов к апи
+func (reloader *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert, nil
+}
+
+// Функция возвращает текущий пул ca
+func (reloader *CertReloader) CAPool() *x509.CertPool {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.caPool
+}
+
+// Функция возвращает текущий сертификат
+func (reloader *CertReloader) leaf() *x509.Certificate {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert.Leaf
+}
+
+// Коллектор срока действия текущих сертификатов, дни считаются в момент сбора метрик
+type certExpiryCollector struct{}
+
+func (certExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certDaysRemainingDesc
+	ch <- certInfoDesc
+}
+
+func (certExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	reloadersMu.Lock()
+	defer reloadersMu.Unlock()
+	for _, reloader := range reloaders {
+		info := certInfo(reloader.leaf())
+		ch <- prometheus.MustNewConstMetric(certDaysRemainingDesc, prometheus.GaugeValue, daysRemaining(info.NotAfter), reloader.source)
+		ch <- prometheus.MustNewConstMetric(certInfoDesc, prometheus.GaugeValue, 1, reloader.source, info.Subject, info.Issuer)
+	}
+}
+
+// Функция возвращает метрики перезагрузки сертификатов для регистрации, коллектор срока действия регистрируется отдельно
+func certReloadCollectors() []prometheus.Collector {
+	return []prometheus.Collector{certReloadsTotal, certLastReloadSuccess, certNotAfter}
+}
@@ -1,96 +1,320 @@
-package pdns
-
-import (
-	"fmt"
-	"log/slog"
-	"sync"
-	"time"
-)
-
-// структура, которая идентифицирует авторити кластер и содержит отчет о доступности кластеров в его составе
-type AvailabilityMegacluster struct {
-	MegaClusterID             string
-	AllSimpleClusters         int8
-	AvailabileSimpleClusters  int8
-	DisableSimpleClusters     int8
-	MaintenanceSimpleClusters int8
-}
-
-// Функция по проверке доступности больших кластеров авторити
-func CheckAvailabilityAuth(conf []AuthCluster, tlsSet MtlsRequests, chAvailMgcl chan []AvailabilityMegacluster) {
-	var dataList []AvailabilityMegacluster
-	// WaitGroup для воркеров, обрабатывающих большие кластера и запускающих другие воркеры
-	var wgAvailAuth sync.WaitGroup
-	// WaitGroup для воркеров, обрабатывающих кластера в составе больших
-	var wgAvailAuthSimple sync.WaitGroup
-	dnsClient := CreateDnsClient()
-	httpClient := CreateHttpClient(tlsSet.Enabled, tlsSet.Cert, tlsSet.Key)
-	for _, megacluster := range conf {
-		var dataMCAvail AvailabilityMegacluster
-		dataMCAvail.AllSimpleClusters = int8(len(megacluster.SimpleClusters))
-		//dataMCAvail.MaintenanceSimpleClusters = int8(len(megacluster.))
-		dataMCAvail.MegaClusterID = megacluster.MegaClusterID
-		wgAvailAuth.Add(1)                 // 1 воркер, обрабатывает большие кластера
-		go func(megacluster AuthCluster) { // воркер обработки, обрабатывает большие кластера
-			//log.Printf("The beginning of the survey of the megacluster %s with %d simple clusters", megacluster.MegaClusterID, len(megacluster.SimpleClusters))
-			slog.Debug(fmt.Sprintf("The beginning of the survey of the megacluster %s with %d simple clusters", megacluster.MegaClusterID, len(megacluster.SimpleClusters)))
-			for _, simplecluster := range megacluster.SimpleClusters {
-				slog.Debug(fmt.Sprintf("The beginning of the survey of the simple cluster %s, nodes: %s %s, http: %s", simplecluster.ClusterID, simplecluster.Master, simplecluster.Slave, simplecluster.Balancer))
-				if simplecluster.Maintenance {
-					dataMCAvail.MaintenanceSimpleClusters++
-				}
-				wgAvailAuthSimple.Add(4) // 1 воркер, в нем 3 горутины
-				chDnsM := make(chan DnsResponseData, len(megacluster.SimpleClusters))
-				chDnsS := make(chan DnsResponseData, len(megacluster.SimpleClusters))
-				chHttp := make(chan HttpResponseData, len(megacluster.SimpleClusters))
-				defer close(chDnsM)
-				defer close(chDnsS)
-				defer close(chHttp)
-				go func(simplecluster SimpleCluster) { // воркер запросов, посылает запросы в хосты маленьких кластеров
-					var dnsRespList []bool
-					var httpRespList []bool
-					// формируются данные для http и dns запросов
-					drdMaster := CreateDnsRequestData(simplecluster.ClusterID, simplecluster.Master, simplecluster.RequestedRecord, simplecluster.DnsPort)
-					drdSlave := CreateDnsRequestData(simplecluster.ClusterID, simplecluster.Slave, simplecluster.RequestedRecord, simplecluster.DnsPort)
-					hrdBalancer := CreateHttpRequestData(simplecluster.ClusterID, simplecluster.Balancer, simplecluster.ApiToken, simplecluster.HttpPort, tlsSet.Enabled)
-					go DnsRequest(drdMaster, chDnsM, dnsClient, &wgAvailAuthSimple)
-					go DnsRequest(drdSlave, chDnsS, dnsClient, &wgAvailAuthSimple)
-					go HttpRequest(hrdBalancer, chHttp, httpClient, &wgAvailAuthSimple)
-				loop: // метка цикла, используется для его прерывания из блока select
-					for {
-						select {
-						// сохраняется bool значение, которое интерпретируется как доступность
-						// в дальнейшем можно переработать и отдавать больше данных наверх
-						case mResp := <-chDnsM:
-							dnsRespList = append(dnsRespList, mResp.Availability)
-						case sResp := <-chDnsS:
-							dnsRespList = append(dnsRespList, sResp.Availability)
-						case hResp := <-chHttp:
-							httpRespList = append(httpRespList, hResp.Availability)
-						case <-time.After(500 * time.Millisecond): // таймаут, если ответы не пришли - выход из цикла ожидания
-							break loop
-						}
-					}
-					defer wgAvailAuthSimple.Done()
-					// если удается получить из списка с bool true, значит сервис доступен
-					checkDnsAvail := ContainBool(dnsRespList, true)
-					checkHttpAvail := ContainBool(httpRespList, true)
-					// если хоть одна из проверок не пройдена, кластер нерабочий
-					if checkDnsAvail && checkHttpAvail {
-						dataMCAvail.AvailabileSimpleClusters = dataMCAvail.AvailabileSimpleClusters + 1
-					} else {
-						dataMCAvail.DisableSimpleClusters = dataMCAvail.DisableSimpleClusters + 1
-					}
-
-					slog.Debug(fmt.Sprintf("The survey of the %s cluster has been completed", simplecluster.ClusterID))
-				}(simplecluster)
-			}
-			wgAvailAuthSimple.Wait()
-			dataList = append(dataList, dataMCAvail)
-			slog.Debug(fmt.Sprintf("The survey of the %s megacluster has been completed", megacluster.MegaClusterID))
-			defer wgAvailAuth.Done()
-		}(megacluster)
-	}
-	wgAvailAuth.Wait()
-	chAvailMgcl <- dataList
-}
+package pdns
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// структура, которая идентифицирует авторити кластер и содержит отчет о доступности кластеров в его составе
+// Started и Completed - время начала и окончания опроса большого кластера
+type AvailabilityMegacluster struct {
+	MegaClusterID             string
+	AllSimpleClusters         int8
+	AvailabileSimpleClusters  int8
+	DisableSimpleClusters     int8
+	MaintenanceSimpleClusters int8
+	SimpleClusters            []AvailabilitySimpleCluster
+	Started                   time.Time
+	Completed                 time.Time
+}
+
+// структура с результатом опроса маленького кластера в составе большого
+// Availability - устойчивое состояние с учетом порогов, RawAvailability - результат текущего цикла
+// Changed - устойчивое состояние сменилось в этом цикле, Started и Completed - время начала и окончания опроса кластера
+type AvailabilitySimpleCluster struct {
+	ClusterID       string
+	Maintenance     bool
+	Availability    bool
+	RawAvailability bool
+	Changed         bool
+	Nodes           []AvailabilityAuthNode
+	Started         time.Time
+	Completed       time.Time
+}
+
+// структура с результатом опроса ноды маленького кластера
+// для master и slave заполняется статистика серии dns запросов, для balancer - код http ответа
+// Address - адрес из конфига, IP и Family - адрес, который опрашивался, и его семейство
+// PeerCert - сертификат апи балансировщика, если запрос выполнялся по https
+// Rcode - rcode последнего ответа master и slave (rcodeNoResponse, если ответа нет), ProbedAt - время начала проверки
+// Duration - длительность проверки (серии dns запросов или http запроса)
+type AvailabilityAuthNode struct {
+	Address       string
+	IP            string
+	Family        string
+	Role          string
+	Availability  bool
+	HttpCode      int16
+	Rcode         int8
+	FailureReason FailureReason
+	FailureDetail string
+	PeerCert      *PeerCert
+	ProbedAt      time.Time
+	Duration      time.Duration
+	SampleStats
+}
+
+// запас к длительности серии dns запросов для таймаута опроса кластера
+const probeTimeoutMargin = 500 * time.Millisecond
+
+// Роли нод маленького кластера
+const (
+	roleMaster   = "master"
+	roleSlave    = "slave"
+	roleBalancer = "balancer"
+)
+
+// Функция по проверке доступности больших кластеров авторити
+func CheckAvailabilityAuth(conf []AuthCluster, tlsSet MtlsRequests, chAvailMgcl chan []AvailabilityMegacluster) {
+	var dataList []AvailabilityMegacluster
+	// мьютекс защищает список результатов, в который пишут воркеры больших кластеров
+	var muDataList sync.Mutex
+	// WaitGroup для воркеров, обрабатывающих большие кластера и запускающих другие воркеры
+	var wgAvailAuth sync.WaitGroup
+	dnsClient := CreateDnsClient()
+	for _, megacluster := range conf {
+		var dataMCAvail AvailabilityMegacluster
+		dataMCAvail.AllSimpleClusters = int8(len(megacluster.SimpleClusters))
+		//dataMCAvail.MaintenanceSimpleClusters = int8(len(megacluster.))
+		dataMCAvail.MegaClusterID = megacluster.MegaClusterID
+		dataMCAvail.Started = time.Now()
+		wgAvailAuth.Add(1)                 // 1 воркер, обрабатывает большие кластера
+		go func(megacluster AuthCluster) { // воркер обработки, обрабатывает большие кластера
+			// WaitGroup для воркеров, обрабатывающих кластера в составе большого, и их запросов
+			var wgAvailAuthSimple sync.WaitGroup
+			// мьютекс защищает счетчики большого кластера, их меняют воркеры маленьких кластеров
+			var muMCAvail sync.Mutex
+			//log.Printf("The beginning of the survey of the megacluster %s with %d simple clusters", megacluster.MegaClusterID, len(megacluster.SimpleClusters))
+			slog.Debug(fmt.Sprintf("The beginning of the survey of the megacluster %s with %d simple clusters", megacluster.MegaClusterID, len(megacluster.SimpleClusters)))
+			for _, simplecluster := range megacluster.SimpleClusters {
+				slog.Debug(fmt.Sprintf("The beginning of the survey of the simple cluster %s, nodes: %s %s, http: %s", simplecluster.ClusterID, simplecluster.Master, simplecluster.Slave, simplecluster.Balancer))
+				if simplecluster.Maintenance {
+					muMCAvail.Lock()
+					dataMCAvail.MaintenanceSimpleClusters++
+					muMCAvail.Unlock()
+				}
+				wgAvailAuthSimple.Add(1)               // 1 воркер, горутины запросов добавляются после разрешения адресов нод
+				go func(simplecluster SimpleCluster) { // воркер запросов, посылает запросы в хосты маленьких кластеров
+					defer wgAvailAuthSimple.Done()
+					var dnsRespList []bool
+					var httpRespList []bool
+					dataSCAvail := AvailabilitySimpleCluster{
+						ClusterID:   simplecluster.ClusterID,
+						Maintenance: simplecluster.Maintenance,
+						Started:     time.Now(),
+					}
+					// адреса нод разрешаются перед опросом, для dual-stack нод опрашивается каждое семейство
+					// ноды, имя которых не разрешилось, сразу попадают в результат как недоступные
+					masters, failedMaster := resolveAuthNode(simplecluster.Master, roleMaster, simplecluster.AddressFamily)
+					slaves, failedSlave := resolveAuthNode(simplecluster.Slave, roleSlave, simplecluster.AddressFamily)
+					balancers, failedBalancer := resolveAuthNode(simplecluster.Balancer, roleBalancer, simplecluster.AddressFamily)
+					for _, failed := range []*AvailabilityAuthNode{failedMaster, failedSlave, failedBalancer} {
+						if failed != nil {
+							dataSCAvail.Nodes = append(dataSCAvail.Nodes, *failed)
+						}
+					}
+					chDnsM := make(chan DnsResponseData, len(masters))
+					chDnsS := make(chan DnsResponseData, len(slaves))
+					chHttp := make(chan HttpResponseData, len(balancers))
+					// http клиент создается на кластер: сертификаты и имя сервера могут быть переопределены для группы или кластера
+					httpClient := CreateHttpClient(requestsTlsFor(tlsSet, megacluster, simplecluster))
+					// ноды, от которых ожидается ответ, по ним определяются не ответившие до таймаута
+					var pending []AvailabilityAuthNode
+					// таймаут опроса кластера: максимальная длительность серии dns запросов и запас,
+					// по нему прекращается ожидание ответов и прерывается http запрос к балансировщику
+					probeCtx, cancelProbe := context.WithTimeout(context.Background(), simplecluster.ProbeSampling.duration()+probeTimeoutMargin)
+					defer cancelProbe()
+					wgAvailAuthSimple.Add(len(masters) + len(slaves) + len(balancers))
+					// формируются данные для http и dns запросов
+					for _, address := range masters {
+						drdMaster := CreateDnsRequestData(simplecluster.ClusterID, address, simplecluster.RequestedRecord, simplecluster.ExpectedAnswer, simplecluster.DnsPort, simplecluster.ProbeSampling)
+						drdMaster.Kind = probeKindAuthDns
+						pending = append(pending, newPendingAuthNode(simplecluster.Master, roleMaster, address))
+						go DnsRequest(drdMaster, chDnsM, dnsClient, &wgAvailAuthSimple)
+					}
+					for _, address := range slaves {
+						drdSlave := CreateDnsRequestData(simplecluster.ClusterID, address, simplecluster.RequestedRecord, simplecluster.ExpectedAnswer, simplecluster.DnsPort, simplecluster.ProbeSampling)
+						drdSlave.Kind = probeKindAuthDns
+						pending = append(pending, newPendingAuthNode(simplecluster.Slave, roleSlave, address))
+						go DnsRequest(drdSlave, chDnsS, dnsClient, &wgAvailAuthSimple)
+					}
+					for _, address := range balancers {
+						hrdBalancer := CreateHttpRequestData(simplecluster.ClusterID, address, simplecluster.ApiToken.Value(), simplecluster.HttpPort, tlsSet.Enabled)
+						pending = append(pending, newPendingAuthNode(simplecluster.Balancer, roleBalancer, address))
+						go HttpRequest(probeCtx, hrdBalancer, chHttp, httpClient, &wgAvailAuthSimple)
+					}
+				loop: // метка цикла, используется для его прерывания из блока select
+					for received := 0; received < len(pending); received++ { // ждем ответ от каждого адреса master, slave и balancer
+						select {
+						// сохраняется bool значение, которое интерпретируется как доступность
+						// статистика серии dns запросов сохраняется по каждой ноде
+						case mResp := <-chDnsM:
+							dnsRespList = append(dnsRespList, mResp.Availability)
+							dataSCAvail.Nodes = append(dataSCAvail.Nodes, newAvailabilityAuthNode(simplecluster.Master, roleMaster, mResp))
+							observeAuthNode(megacluster.MegaClusterID, simplecluster.ClusterID, simplecluster.Master, roleMaster, mResp)
+						case sResp := <-chDnsS:
+							dnsRespList = append(dnsRespList, sResp.Availability)
+							dataSCAvail.Nodes = append(dataSCAvail.Nodes, newAvailabilityAuthNode(simplecluster.Slave, roleSlave, sResp))
+							observeAuthNode(megacluster.MegaClusterID, simplecluster.ClusterID, simplecluster.Slave, roleSlave, sResp)
+						case hResp := <-chHttp:
+							httpRespList = append(httpRespList, hResp.Availability)
+							dataSCAvail.Nodes = append(dataSCAvail.Nodes, newAvailabilityBalancerNode(simplecluster.Balancer, hResp))
+						case <-probeCtx.Done(): // таймаут, если ответы не пришли - выход из цикла ожидания
+							break loop
+						}
+					}
+					// ноды, не ответившие до таймаута, считаются недоступными с причиной probe_timeout
+					dataSCAvail.Nodes = append(dataSCAvail.Nodes, missingAuthNodes(pending, dataSCAvail.Nodes)...)
+					for _, node := range dataSCAvail.Nodes {
+						if !node.Availability {
+							reportAuthNodeFailure(megacluster.MegaClusterID, simplecluster.ClusterID, node)
+						}
+					}
+					// если удается получить из списка с bool true, значит сервис доступен
+					checkDnsAvail := ContainBool(dnsRespList, true)
+					checkHttpAvail := ContainBool(httpRespList, true)
+					// если хоть одна из проверок не пройдена, кластер нерабочий
+					muMCAvail.Lock()
+					defer muMCAvail.Unlock()
+					dataSCAvail.RawAvailability = checkDnsAvail && checkHttpAvail
+					// в счетчики большого кластера попадает устойчивое состояние, а не результат одного цикла
+					stateKey := simpleClusterStateKey(megacluster.MegaClusterID, simplecluster.ClusterID)
+					up, changed := targetStates.Update(stateKey, dataSCAvail.RawAvailability, simplecluster.StateHysteresis)
+					if !dataSCAvail.RawAvailability {
+						targetStates.RecordFailure(stateKey, nodesFailure(dataSCAvail.Nodes))
+					}
+					if changed {
+						stateTransitionsSimpleCluster.WithLabelValues(megacluster.MegaClusterID, simplecluster.ClusterID).Inc()
+					}
+					dataSCAvail.Availability = up
+					dataSCAvail.Changed = changed
+					dataSCAvail.Completed = time.Now()
+					if dataSCAvail.Availability {
+						dataMCAvail.AvailabileSimpleClusters = dataMCAvail.AvailabileSimpleClusters + 1
+					} else {
+						dataMCAvail.DisableSimpleClusters = dataMCAvail.DisableSimpleClusters + 1
+					}
+					dataMCAvail.SimpleClusters = append(dataMCAvail.SimpleClusters, dataSCAvail)
+
+					slog.Debug(fmt.Sprintf("The survey of the %s cluster has been completed", simplecluster.ClusterID))
+				}(simplecluster)
+			}
+			wgAvailAuthSimple.Wait()
+			dataMCAvail.Completed = time.Now()
+			muDataList.Lock()
+			dataList = append(dataList, dataMCAvail)
+			muDataList.Unlock()
+			slog.Debug(fmt.Sprintf("The survey of the %s megacluster has been completed", megacluster.MegaClusterID))
+			defer wgAvailAuth.Done()
+		}(megacluster)
+	}
+	wgAvailAuth.Wait()
+	chAvailMgcl <- dataList
+}
+
+// Функция записывает время ответов ноды авторити кластера в гистограмму, таймауты не учитываются
+func observeAuthNode(megaClusterID, clusterID, node, role string, resp DnsResponseData) {
+	for _, sample := range resp.Samples {
+		authNodeResponseTime.WithLabelValues(megaClusterID, clusterID, node, role, resp.Family).Observe(sample.Seconds())
+	}
+}
+
+// Функция разрешает адрес ноды, при ошибке возвращает пустой список и результат опроса с причиной name_resolution
+func resolveAuthNode(address, role, family string) ([]ProbeAddress, *AvailabilityAuthNode) {
+	addresses, err := resolveProbeAddresses(address, family)
+	if err != nil {
+		failed := newPendingAuthNode(address, role, unresolvedAddress(address))
+		failed.FailureReason = classifyError(err)
+		failed.FailureDetail = err.Error()
+		return nil, &failed
+	}
+	return addresses, nil
+}
+
+// Функция создает результат опроса ноды, от которой еще не получен ответ
+func newPendingAuthNode(address, role string, probeAddress ProbeAddress) AvailabilityAuthNode {
+	return AvailabilityAuthNode{
+		Address:  address,
+		IP:       probeAddress.IP,
+		Family:   probeAddress.Family,
+		Role:     role,
+		Rcode:    rcodeNoResponse,
+		ProbedAt: time.Now(),
+	}
+}
+
+// Функция создает результат опроса ноды из ответа на серию dns запросов
+func newAvailabilityAuthNode(address, role string, resp DnsResponseData) AvailabilityAuthNode {
+	return AvailabilityAuthNode{
+		Address:       address,
+		IP:            resp.Address,
+		Family:        resp.Family,
+		Role:          role,
+		Availability:  resp.Availability,
+		Rcode:         responseRcode(resp.Msg),
+		FailureReason: resp.FailureReason,
+		FailureDetail: resp.FailureDetail,
+		PeerCert:      resp.PeerCert,
+		ProbedAt:      resp.Started,
+		Duration:      resp.Duration,
+		SampleStats:   resp.SampleStats,
+	}
+}
+
+// Функция создает результат опроса балансировщика из ответа на http запрос
+func newAvailabilityBalancerNode(address string, resp HttpResponseData) AvailabilityAuthNode {
+	return AvailabilityAuthNode{
+		Address:       address,
+		IP:            resp.Address,
+		Family:        resp.Family,
+		Role:          roleBalancer,
+		Availability:  resp.Availability,
+		HttpCode:      resp.ResponseCode,
+		FailureReason: resp.FailureReason,
+		FailureDetail: resp.FailureDetail,
+		PeerCert:      resp.PeerCert,
+		ProbedAt:      resp.Started,
+		Duration:      resp.Duration,
+	}
+}
+
+// Функция возвращает ноды из списка ожидаемых, от которых не пришел ответ
+func missingAuthNodes(pending, received []AvailabilityAuthNode) []AvailabilityAuthNode {
+	var missing []AvailabilityAuthNode
+	for _, node := range pending {
+		found := false
+		for _, receivedNode := range received {
+			if receivedNode.Role == node.Role && receivedNode.IP == node.IP && receivedNode.Family == node.Family {
+				found = true
+			}
+		}
+		if !found {
+			node.FailureReason = ReasonProbeTimeout
+			node.FailureDetail = "no response before the probe deadline"
+			node.Duration = time.Since(node.ProbedAt)
+			missing = append(missing, node)
+		}
+	}
+	return missing
+}
+
+// Функция возвращает причины отказа нод кластера одной строкой для истории состояния
+func nodesFailure(nodes []AvailabilityAuthNode) string {
+	var failures []string
+	for _, node := range nodes {
+		if !node.Availability {
+			failures = append(failures, fmt.Sprintf("%s %s (%s): %s", node.Role, node.Address, node.Family, node.FailureReason))
+		}
+	}
+	return strings.Join(failures, ", ")
+}
+
+// Функция логирует неудачную проверку ноды и увеличивает счетчик отказов с причиной
+func reportAuthNodeFailure(megaClusterID, clusterID string, node AvailabilityAuthNode) {
+	slog.Warn(fmt.Sprintf("The check of the %s %s (%s) of the %s cluster failed, reason: %s, detail: %s", node.Role, node.Address, node.Family, clusterID, node.FailureReason, node.FailureDetail))
+	probeFailuresAuthNode.WithLabelValues(megaClusterID, clusterID, node.Address, node.Role, node.Family, string(node.FailureReason)).Inc()
+}
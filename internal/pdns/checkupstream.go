@@ -1,51 +1,111 @@
-package pdns
-
-import (
-	"fmt"
-	"log/slog"
-	"sync"
-	"time"
-)
-
-// структура, возвращающая rcode dns запроса, id апстрима и время ответа
-type AvailabilityRecursor struct {
-	RecursorID   string
-	Rcode        int8
-	ResponseTime time.Duration
-}
-
-func CheckAvailabilityRecursor(conf []RecursorServer, chAvailUpstr chan []AvailabilityRecursor) {
-	var availList []AvailabilityRecursor
-	var rcode int8
-	// Для функций CheckAvailabilityAuth и CheckAvailabilityRecursor разные WaitGroup во избежание блокировок
-	var wgAvailUpstrWg sync.WaitGroup
-	dnsClient := CreateDnsClient()
-	for _, server := range conf {
-		wgAvailUpstrWg.Add(2) // 1 воркер и 1 горутина
-		// замыкание исполняет роль воркера для каждого сервера, ответы пишет в список
-		go func(server RecursorServer) {
-			slog.Debug(fmt.Sprintf("The beginning of the survey of the Recursor %s", server.RecursorID))
-			chDns := make(chan DnsResponseData, len(conf))
-			defer wgAvailUpstrWg.Done()
-			requestData := CreateDnsRequestData(server.RecursorID, server.Address, server.Fqdn, server.DnsPort)
-			go DnsRequest(requestData, chDns, dnsClient, &wgAvailUpstrWg)
-
-			data := <-chDns
-
-			if data.Msg == nil { // если сервер не ответил, ставим rcode 111 (условно - рефьюз)
-				rcode = int8(111)
-			} else {
-				rcode = int8(data.Msg.Rcode)
-			}
-			availList = append(availList, AvailabilityRecursor{
-				RecursorID:   data.ServerID,
-				Rcode:        rcode,
-				ResponseTime: data.TimeToResponse,
-			})
-			slog.Debug(fmt.Sprintf("The survey of the %s Recursor has been completed", server.RecursorID))
-			defer close(chDns)
-		}(server)
-	}
-	wgAvailUpstrWg.Wait()
-	chAvailUpstr <- availList
-}
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// структура, возвращающая rcode dns запроса, id апстрима, среднее время ответа и статистику серии запросов
+// Availability - устойчивое состояние с учетом порогов, RawAvailability - результат текущего цикла, Changed - состояние сменилось в этом цикле
+// Address и Family - опрошенный адрес и его семейство
+type AvailabilityRecursor struct {
+	RecursorID      string
+	Address         string
+	Family          string
+	Rcode           int8
+	ResponseTime    time.Duration
+	Availability    bool
+	RawAvailability bool
+	Changed         bool
+	FailureReason   FailureReason
+	FailureDetail   string
+	PeerCert        *PeerCert     // сертификат сервера для DoT и DoH
+	ProbedAt        time.Time     // время начала последней проверки
+	Duration        time.Duration // длительность последней проверки
+	SampleStats
+}
+
+func CheckAvailabilityRecursor(conf []RecursorServer, chAvailUpstr chan []AvailabilityRecursor) {
+	var availList []AvailabilityRecursor
+	// мьютекс защищает список ответов, в который пишут воркеры
+	var muAvailList sync.Mutex
+	// Для функций CheckAvailabilityAuth и CheckAvailabilityRecursor разные WaitGroup во избежание блокировок
+	var wgAvailUpstrWg sync.WaitGroup
+	dnsClient := CreateDnsClient()
+	for _, server := range conf {
+		wgAvailUpstrWg.Add(1) // 1 воркер, горутины запросов добавляются после разрешения адреса
+		// замыкание исполняет роль воркера для каждого сервера, ответы пишет в список
+		// для dual-stack сервера опрашивается каждое семейство адресов, результат по каждому - отдельно
+		go func(server RecursorServer) {
+			defer wgAvailUpstrWg.Done()
+			slog.Debug(fmt.Sprintf("The beginning of the survey of the Recursor %s", server.RecursorID))
+			var responses []DnsResponseData
+			addresses, err := resolveProbeAddresses(server.Address, server.AddressFamily)
+			if err != nil { // имя не разрешилось, запросы не выполняются
+				unresolved := unresolvedAddress(server.Address)
+				responses = append(responses, DnsResponseData{
+					ServerID:      server.RecursorID,
+					Family:        unresolved.Family,
+					FailureReason: classifyError(err),
+					FailureDetail: err.Error(),
+					Started:       time.Now(),
+				})
+			}
+			chDns := make(chan DnsResponseData, len(addresses))
+			wgAvailUpstrWg.Add(len(addresses))
+			for _, address := range addresses {
+				requestData := CreateDnsRequestData(server.RecursorID, address, server.Fqdn, server.ExpectedAnswer, server.DnsPort, server.ProbeSampling)
+				requestData.Protocol = server.Protocol
+				requestData.DohPath = server.DohPath
+				requestData.Kind = probeKindRecursorDns
+				go DnsRequest(requestData, chDns, dnsClient, &wgAvailUpstrWg)
+			}
+			for range addresses {
+				responses = append(responses, <-chDns)
+			}
+
+			for _, data := range responses {
+				rcode := responseRcode(data.Msg) // если сервер не ответил, rcode 111 (условно - рефьюз)
+				// в гистограмму попадают только полученные ответы, таймауты исказили бы распределение
+				for _, sample := range data.Samples {
+					recursorResponseTime.WithLabelValues(server.RecursorID, data.Family).Observe(sample.Seconds())
+				}
+				if !data.Availability {
+					slog.Warn(fmt.Sprintf("The check of the %s Recursor (%s) failed, reason: %s, detail: %s", server.RecursorID, data.Family, data.FailureReason, data.FailureDetail))
+					probeFailuresRecursor.WithLabelValues(server.RecursorID, data.Family, string(data.FailureReason)).Inc()
+				}
+				stateKey := recursorStateKey(server.RecursorID, data.Family)
+				up, changed := targetStates.Update(stateKey, data.Availability, server.StateHysteresis)
+				if !data.Availability {
+					targetStates.RecordFailure(stateKey, fmt.Sprintf("%s: %s", data.FailureReason, data.FailureDetail))
+				}
+				if changed {
+					stateTransitionsRecursor.WithLabelValues(server.RecursorID, data.Family).Inc()
+				}
+				muAvailList.Lock()
+				availList = append(availList, AvailabilityRecursor{
+					RecursorID:      server.RecursorID,
+					Address:         data.Address,
+					Family:          data.Family,
+					Rcode:           rcode,
+					ResponseTime:    data.TimeToResponse,
+					Availability:    up,
+					RawAvailability: data.Availability,
+					Changed:         changed,
+					FailureReason:   data.FailureReason,
+					FailureDetail:   data.FailureDetail,
+					PeerCert:        data.PeerCert,
+					ProbedAt:        data.Started,
+					Duration:        data.Duration,
+					SampleStats:     data.SampleStats,
+				})
+				muAvailList.Unlock()
+			}
+			slog.Debug(fmt.Sprintf("The survey of the %s Recursor has been completed", server.RecursorID))
+		}(server)
+	}
+	wgAvailUpstrWg.Wait()
+	chAvailUpstr <- availList
+}
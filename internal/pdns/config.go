@@ -1,114 +1,273 @@
-package pdns
-
-import (
-	"encoding/json"
-	"flag"
-	"fmt"
-	"log/slog"
-	"os"
-
-	"github.com/go-playground/validator/v10"
-)
-
-// Структура конфигурационного файла, она состоит из других структур, отвечающих за конкретную часть конфига
-type Conf struct {
-	LogPath         string       `json:"logPath" validate:"required"`
-	LogLevel        string       `json:"logLevel" validate:"oneof='DEBUG' 'INFO' 'WARN' 'ERROR'"`
-	MtlsExporter    MtlsExporter `json:"mtlsExporter" validate:"required"`
-	MtlsRequest     MtlsRequests `json:"mtlsRequests" validate:"required"`
-	RecursorServers []RecursorServer
-	AuthClusters    []AuthCluster
-}
-
-// Структура для части конфига отвечающего за mtls страницы экспортера
-type MtlsExporter struct {
-	Enabled   bool     `json:"enabled" validate:"boolean"`
-	Key       string   `json:"key" validate:"required_with=Enabled"`
-	Cert      string   `json:"cert" validate:"required_with=Enabled"`
-	AllowedCN []string `json:"allowedCN" validate:"required_with=Enabled"`
-}
-
-// Структура для части конфига отвечающего за mtls при обращении к апи серверов авторити
-type MtlsRequests struct {
-	Enabled bool   `json:"enabled" validate:"boolean"`
-	Key     string `json:"key" validate:"required_with=Enabled"`
-	Cert    string `json:"cert" validate:"required_with=Enabled"`
-}
-
-// Структура, описывающая часть конфига с апстрим серверами для днс опросов
-type RecursorDns struct {
-	RecursorServers []string
-}
-
-// Структура, описывающая сам сервер (его параметры)
-type RecursorServer struct {
-	RecursorID string `json:"recursorID" validate:"required"`
-	Address    string `json:"address" validate:"required"`
-	Fqdn       string `json:"record" validate:"required"`
-	DnsPort    int32  `json:"dnsPort" validate:"required"`
-}
-
-// Структура части конфига (группа больших авторити днс кластеров для опроса)
-type AuthCluster struct {
-	MegaClusterID  string          `json:"groupClusterID" validate:"required"`
-	SimpleClusters []SimpleCluster `json:"authClusters" validate:"required"`
-}
-
-// Структура части конфига (группа маленьких днс кластеров для запросов в их сторону)
-type SimpleCluster struct {
-	ClusterID       string `json:"clusterID" validate:"required"`
-	Master          string `json:"master" validate:"required"`
-	Slave           string `json:"slave" validate:"required"`
-	Balancer        string `json:"balancer" validate:"required"`
-	HttpPort        int32  `json:"httpPort" validate:"required"`
-	DnsPort         int32  `json:"dnsPort" validate:"required"`
-	RequestedRecord string `json:"requestedPort" validate:"required"`
-	ApiToken        string `json:"apiToken" validate:"required"`
-	Maintenance     bool   `json:"maintenance" validate:"boolean"`
-}
-
-// Функция для чтения конфигурационного файла
-func GetConfig() (*Conf, error) {
-	var path string
-	flag.StringVar(&path, "c", "/etc/ddidnser/config.json", "path to config file")
-	flag.Parse()
-	plan, errRead := os.ReadFile(path)
-	if errRead != nil {
-		slog.Error(errRead.Error())
-		return nil, errRead
-	}
-	var Config Conf
-	err := json.Unmarshal(plan, &Config)
-
-	validate := validator.New()
-	if err := validate.Struct(Config); err != nil {
-		errs := err.(validator.ValidationErrors)
-		for _, fieldErr := range errs {
-			slog.Error(fmt.Sprintf("field %s %s %s\n", fieldErr.Namespace(), fieldErr.ActualTag(), fieldErr.Param()))
-		}
-		return nil, err
-	}
-
-	if err != nil {
-		return &Config, err
-	}
-	return &Config, nil
-}
-
-func ContainBool(listing []bool, key bool) bool {
-	for _, value := range listing {
-		if key == value {
-			return true
-		}
-	}
-	return false
-}
-
-func ContainString(listing []string, key string) bool {
-	for _, value := range listing {
-		if key == value {
-			return true
-		}
-	}
-	return false
-}
+package pdns
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"main/pkg/web"
+	"os"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Структура конфигурационного файла, она состоит из других структур, отвечающих за конкретную часть конфига
+type Conf struct {
+	LogPath         string       `json:"logPath" validate:"required"`
+	LogLevel        string       `json:"logLevel" validate:"oneof='DEBUG' 'INFO' 'WARN' 'ERROR'"`
+	MtlsExporter    MtlsExporter `json:"mtlsExporter" validate:"required"`
+	MtlsRequest     MtlsRequests `json:"mtlsRequests" validate:"required"`
+	RecursorServers []RecursorServer
+	AuthClusters    []AuthCluster
+	// интервал фонового опроса в секундах и границы бакетов гистограмм времени ответа в секундах
+	ProbeInterval       int       `json:"probeInterval" validate:"gte=0"`
+	ResponseTimeBuckets []float64 `json:"responseTimeBuckets"`
+	// интервал проверки файлов сертификатов и bearer токенов на изменение в секундах
+	CertReloadInterval int `json:"certReloadInterval" validate:"gte=0"`
+	// интервал обновления секретов (apiToken) из env:, file: и exec: в секундах
+	SecretRefreshInterval int `json:"secretRefreshInterval" validate:"gte=0"`
+	// подключение к vault для ссылок vault: в apiToken
+	Vault VaultSettings `json:"vault"`
+	// basic auth и bearer токены для страницы экспортера, работают отдельно или вместе с mtls
+	WebAuth web.Credentials `json:"webAuth"`
+	// списки подсетей, с которых допускаются запросы к экспортеру
+	IPFilter web.IPFilterSettings `json:"ipFilter"`
+	// разграничение доступа команд к метрикам своих групп и рекурсоров, если пусто - метрики видны всем
+	Tenants []Tenant `json:"tenants" validate:"dive"`
+	// получатели уведомлений о смене состояния кластеров и рекурсоров
+	Webhooks []WebhookReceiver `json:"webhooks" validate:"dive"`
+	// отправка алертов о деградации групп и недоступности рекурсоров напрямую в alertmanager
+	Alertmanager AlertmanagerSettings `json:"alertmanager"`
+	// отправка метрик в pushgateway после каждого цикла опроса
+	Pushgateway PushgatewaySettings `json:"pushgateway"`
+	// отправка метрик по протоколу remote write после каждого цикла опроса
+	RemoteWrite RemoteWriteSettings `json:"remoteWrite"`
+	// экспорт метрик и трейсов циклов опроса в OpenTelemetry collector по OTLP/HTTP
+	Otlp OtlpSettings `json:"otlp"`
+	// выводы результатов циклов опроса во внешние системы (InfluxDB, Graphite)
+	Outputs []OutputSettings `json:"outputs" validate:"dive"`
+}
+
+// Значения по умолчанию для фонового опроса и проверки сертификатов
+const (
+	defaultProbeInterval      = 15
+	defaultCertReloadInterval = 60
+)
+
+var defaultResponseTimeBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .15, .2, .3}
+
+// Структура для части конфига отвечающего за mtls страницы экспортера
+// ClientCA - бандл ca для проверки клиентских сертификатов, ClientAuth - режим запроса сертификата (require, request, none)
+// MinVersion - минимальная версия tls (1.0 - 1.3), CipherSuites - имена наборов шифров для tls 1.0-1.2, для 1.3 они не настраиваются
+type MtlsExporter struct {
+	Enabled      bool     `json:"enabled" validate:"boolean"`
+	Key          string   `json:"key" validate:"required_with=Enabled"`
+	Cert         string   `json:"cert" validate:"required_with=Enabled"`
+	ClientCA     string   `json:"clientCA"`
+	ClientAuth   string   `json:"clientAuth" validate:"omitempty,oneof=require request none"`
+	MinVersion   string   `json:"minVersion" validate:"omitempty,oneof=1.0 1.1 1.2 1.3"`
+	CipherSuites []string `json:"cipherSuites"`
+	// допуск клиентов: allowedCN - точные CN, allowRules - правила по CN, SAN, SPIFFE ID и OU (exact, glob или regex)
+	AllowedCN  []string        `json:"allowedCN"`
+	AllowRules []web.AllowRule `json:"allowRules" validate:"dive"`
+}
+
+// Структура для части конфига отвечающего за mtls при обращении к апи серверов авторити
+// CA - бандл ca для проверки сертификатов апи, если не задан - используется файл сертификата (как раньше)
+type MtlsRequests struct {
+	Enabled bool   `json:"enabled" validate:"boolean"`
+	Key     string `json:"key" validate:"required_with=Enabled"`
+	Cert    string `json:"cert" validate:"required_with=Enabled"`
+	CA      string `json:"ca"`
+}
+
+// Переопределение tls запросов к апи для группы или кластера, настройки кластера имеют приоритет над настройками группы
+// TlsServerName - имя для SNI и проверки сертификата, когда балансировщик задан ip адресом
+// TlsCA, TlsCert и TlsKey - бандл ca и клиентский сертификат для групп под другим PKI, по умолчанию берутся из mtlsRequests
+type RequestsTls struct {
+	TlsServerName string `json:"tlsServerName"`
+	TlsCA         string `json:"tlsCA"`
+	TlsCert       string `json:"tlsCert" validate:"required_with=TlsKey"`
+	TlsKey        string `json:"tlsKey" validate:"required_with=TlsCert"`
+}
+
+// Структура, описывающая команду и доступные ей метрики
+// клиент определяется по имени basic auth или bearer токена (users) или по правилам сертификата (allowRules)
+// groupClusterIDs и recursorIDs - доступные группы и рекурсоры, "*" - все
+type Tenant struct {
+	Name            string          `json:"name" validate:"required"`
+	Users           []string        `json:"users"`
+	AllowRules      []web.AllowRule `json:"allowRules" validate:"dive"`
+	GroupClusterIDs []string        `json:"groupClusterIDs"`
+	RecursorIDs     []string        `json:"recursorIDs"`
+}
+
+// Структура, описывающая часть конфига с апстрим серверами для днс опросов
+type RecursorDns struct {
+	RecursorServers []string
+}
+
+// Структура, описывающая сам сервер (его параметры)
+type RecursorServer struct {
+	RecursorID string `json:"recursorID" validate:"required"`
+	Address    string `json:"address" validate:"required"`
+	Fqdn       string `json:"record" validate:"required"`
+	DnsPort    int32  `json:"dnsPort" validate:"required"`
+	// ожидаемый ip адрес в ответе, если не задан - проверяется только rcode
+	ExpectedAnswer string `json:"expectedAnswer" validate:"omitempty,ip"`
+	// семейство адресов при опросе по имени: any, ip4, ip6 или both (опрос обоих семейств)
+	AddressFamily string `json:"addressFamily" validate:"omitempty,oneof=any ip4 ip6 both"`
+	// протокол опроса: udp (по умолчанию), tcp, tls (DoT) или https (DoH), для https - путь запроса (по умолчанию /dns-query)
+	Protocol string `json:"protocol" validate:"omitempty,oneof=udp tcp tls https"`
+	DohPath  string `json:"dohPath"`
+	// описание и лейблы для алертов
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels"`
+	ProbeSampling
+	StateHysteresis
+}
+
+// Структура части конфига (группа больших авторити днс кластеров для опроса)
+// Description и Labels - описание и лейблы группы для алертов
+type AuthCluster struct {
+	MegaClusterID  string            `json:"groupClusterID" validate:"required"`
+	SimpleClusters []SimpleCluster   `json:"authClusters" validate:"required"`
+	Description    string            `json:"description"`
+	Labels         map[string]string `json:"labels"`
+	RequestsTls
+}
+
+// Структура части конфига (группа маленьких днс кластеров для запросов в их сторону)
+type SimpleCluster struct {
+	ClusterID       string `json:"clusterID" validate:"required"`
+	Master          string `json:"master" validate:"required"`
+	Slave           string `json:"slave" validate:"required"`
+	Balancer        string `json:"balancer" validate:"required"`
+	HttpPort        int32  `json:"httpPort" validate:"required"`
+	DnsPort         int32  `json:"dnsPort" validate:"required"`
+	RequestedRecord string `json:"requestedPort" validate:"required"`
+	ApiToken        Secret `json:"apiToken"` // обязателен, литерал или ссылка env:, file:, exec:, vault:
+	Maintenance     bool   `json:"maintenance" validate:"boolean"`
+	ExpectedAnswer  string `json:"expectedAnswer" validate:"omitempty,ip"`
+	AddressFamily   string `json:"addressFamily" validate:"omitempty,oneof=any ip4 ip6 both"`
+	Description     string `json:"description"`
+	ProbeSampling
+	StateHysteresis
+	RequestsTls
+}
+
+// Структура части конфига (серия dns запросов к одному серверу за цикл опроса), встраивается в RecursorServer и SimpleCluster
+type ProbeSampling struct {
+	Samples        int      `json:"samples" validate:"gte=0"`                       // количество запросов за цикл
+	SampleInterval int      `json:"sampleInterval" validate:"gte=0"`                // пауза между запросами в миллисекундах
+	LossThreshold  *float64 `json:"lossThreshold" validate:"omitempty,gte=0,lte=1"` // доля потерь, при которой сервер еще считается доступным
+}
+
+// Значения по умолчанию для серии запросов, один запрос за цикл ведет себя как раньше
+const (
+	defaultSamples        = 1
+	defaultSampleInterval = 100
+	defaultLossThreshold  = 0.5
+)
+
+// Количество запросов за цикл
+func (s ProbeSampling) count() int {
+	if s.Samples <= 0 {
+		return defaultSamples
+	}
+	return s.Samples
+}
+
+// Пауза между запросами серии
+func (s ProbeSampling) interval() time.Duration {
+	if s.SampleInterval <= 0 {
+		return defaultSampleInterval * time.Millisecond
+	}
+	return time.Duration(s.SampleInterval) * time.Millisecond
+}
+
+// Порог потерь для признания сервера доступным
+func (s ProbeSampling) threshold() float64 {
+	if s.LossThreshold == nil {
+		return defaultLossThreshold
+	}
+	return *s.LossThreshold
+}
+
+// Максимальная длительность серии: каждый запрос ждет ответ до dnsQueryTimeout, между запросами пауза
+func (s ProbeSampling) duration() time.Duration {
+	return time.Duration(s.count())*dnsQueryTimeout + time.Duration(s.count()-1)*s.interval()
+}
+
+// Структура части конфига (пороги смены состояния цели), встраивается в RecursorServer и SimpleCluster
+// состояние меняется только после нескольких подряд неудачных или успешных циклов опроса
+type StateHysteresis struct {
+	FailuresBeforeDown int `json:"failuresBeforeDown" validate:"gte=0"`
+	SuccessesBeforeUp  int `json:"successesBeforeUp" validate:"gte=0"`
+}
+
+// Количество неудачных циклов подряд для перехода в недоступное состояние, по умолчанию 1
+func (h StateHysteresis) failures() int {
+	return max(h.FailuresBeforeDown, 1)
+}
+
+// Количество успешных циклов подряд для перехода в доступное состояние, по умолчанию 1
+func (h StateHysteresis) successes() int {
+	return max(h.SuccessesBeforeUp, 1)
+}
+
+// Функция для чтения конфигурационного файла
+func GetConfig() (*Conf, error) {
+	var path string
+	flag.StringVar(&path, "c", "/etc/ddidnser/config.json", "path to config file")
+	flag.Parse()
+	plan, errRead := os.ReadFile(path)
+	if errRead != nil {
+		slog.Error(errRead.Error())
+		return nil, errRead
+	}
+	configHash = fmt.Sprintf("%x", sha256.Sum256(plan))
+	var Config Conf
+	err := json.Unmarshal(plan, &Config)
+
+	validate := validator.New()
+	if err := validate.Struct(Config); err != nil {
+		errs := err.(validator.ValidationErrors)
+		for _, fieldErr := range errs {
+			slog.Error(fmt.Sprintf("field %s %s %s\n", fieldErr.Namespace(), fieldErr.ActualTag(), fieldErr.Param()))
+		}
+		return nil, err
+	}
+
+	if err != nil {
+		return &Config, err
+	}
+	if Config.ProbeInterval == 0 {
+		Config.ProbeInterval = defaultProbeInterval
+	}
+	if Config.CertReloadInterval == 0 {
+		Config.CertReloadInterval = defaultCertReloadInterval
+	}
+	if len(Config.ResponseTimeBuckets) == 0 {
+		Config.ResponseTimeBuckets = defaultResponseTimeBuckets
+	}
+	if Config.SecretRefreshInterval == 0 {
+		Config.SecretRefreshInterval = defaultSecretRefreshInterval
+	}
+	if err := resolveSecrets(&Config); err != nil {
+		slog.Error(err.Error())
+		return nil, err
+	}
+	return &Config, nil
+}
+
+func ContainBool(listing []bool, key bool) bool {
+	for _, value := range listing {
+		if key == value {
+			return true
+		}
+	}
+	return false
+}
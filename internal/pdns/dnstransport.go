@@ -0,0 +1,129 @@
+package pdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Протоколы опроса рекурсоров: udp, tcp, DoT (tls) и DoH (https)
+const (
+	protocolUDP   = "udp"
+	protocolTCP   = "tcp"
+	protocolTLS   = "tls"
+	protocolHTTPS = "https"
+)
+
+const (
+	defaultDohPath = "/dns-query"
+	// таймаут подключения по tcp и tls больше, чем для udp: в него входит tls рукопожатие
+	streamDialTimeout = 2 * time.Second
+	dohTimeout        = 2 * time.Second
+)
+
+// Функция выполняет один dns запрос выбранным протоколом
+// возвращает ответ, время ответа и сертификат сервера (только для tls и https)
+type dnsExchangeFunc func(msg *dns.Msg) (*dns.Msg, time.Duration, *PeerCert, error)
+
+// Функция выбирает способ выполнения запросов серии по протоколу, udp выполняется общим клиентом dnsClient
+func newDnsExchange(drd DnsRequestData, dnsClient *dns.Client) dnsExchangeFunc {
+	target := net.JoinHostPort(drd.Address, strconv.Itoa(int(drd.Port)))
+	switch drd.Protocol {
+	case protocolTCP:
+		client := &dns.Client{Net: "tcp", Dialer: &net.Dialer{Timeout: streamDialTimeout}}
+		return func(msg *dns.Msg) (*dns.Msg, time.Duration, *PeerCert, error) {
+			resp, ttr, err := client.Exchange(msg, target)
+			return resp, ttr, nil, err
+		}
+	case protocolTLS:
+		// сертификат проверяется по имени из конфига (для ip адреса - по ip в SAN)
+		client := &dns.Client{
+			Net:       "tcp-tls",
+			Dialer:    &net.Dialer{Timeout: streamDialTimeout},
+			TLSConfig: &tls.Config{ServerName: drd.Host},
+		}
+		return func(msg *dns.Msg) (*dns.Msg, time.Duration, *PeerCert, error) {
+			return exchangeDot(client, msg, target)
+		}
+	case protocolHTTPS:
+		return newDohExchange(drd)
+	default:
+		return func(msg *dns.Msg) (*dns.Msg, time.Duration, *PeerCert, error) {
+			resp, ttr, err := dnsClient.Exchange(msg, target)
+			return resp, ttr, nil, err
+		}
+	}
+}
+
+// Функция выполняет запрос DoT, соединение устанавливается отдельно, чтобы получить сертификат сервера
+func exchangeDot(client *dns.Client, msg *dns.Msg, target string) (*dns.Msg, time.Duration, *PeerCert, error) {
+	conn, err := client.Dial(target)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer conn.Close()
+	var peerCert *PeerCert
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		peerCert = newPeerCert(&state)
+	}
+	resp, ttr, err := client.ExchangeWithConn(msg, conn)
+	return resp, ttr, peerCert, err
+}
+
+// Функция создает выполнение запросов DoH (RFC 8484, метод POST)
+// подключение выполняется к разрешенному адресу, имя из конфига идет в url и используется для проверки сертификата
+func newDohExchange(drd DnsRequestData) dnsExchangeFunc {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialProbeAddress(&net.Dialer{Timeout: streamDialTimeout})
+	// как и для апи, соединения не переиспользуются: время ответа каждого запроса серии включает рукопожатие
+	transport.DisableKeepAlives = true
+	httpClient := &http.Client{Transport: transport, Timeout: dohTimeout}
+	path := drd.DohPath
+	if path == "" {
+		path = defaultDohPath
+	}
+	url := fmt.Sprintf("https://%s%s", net.JoinHostPort(drd.Host, strconv.Itoa(int(drd.Port))), path)
+	address := ProbeAddress{Host: drd.Host, IP: drd.Address, Family: drd.Family}
+	return func(msg *dns.Msg) (*dns.Msg, time.Duration, *PeerCert, error) {
+		packed, err := msg.Pack()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		ctx := context.WithValue(context.Background(), dialAddressKey{}, address)
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(packed))
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		defer resp.Body.Close()
+		peerCert := newPeerCert(resp.TLS)
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, peerCert, &httpStatusError{code: resp.StatusCode, status: resp.Status}
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, 0, peerCert, err
+		}
+		ttr := time.Since(start)
+		answer := new(dns.Msg)
+		if err := answer.Unpack(body); err != nil {
+			return nil, ttr, peerCert, err
+		}
+		return answer, ttr, peerCert, nil
+	}
+}
@@ -0,0 +1,100 @@
+package pdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Причина неудачной проверки, передается в ответах dns и http запросов и используется как лейбл метрики
+type FailureReason string
+
+const (
+	ReasonNone               FailureReason = ""
+	ReasonDialTimeout        FailureReason = "dial_timeout"
+	ReasonReadTimeout        FailureReason = "read_timeout"
+	ReasonProbeTimeout       FailureReason = "probe_timeout" // ответ не пришел до окончания цикла ожидания
+	ReasonConnectionRefused  FailureReason = "connection_refused"
+	ReasonNetworkUnreachable FailureReason = "network_unreachable"
+	ReasonNameResolution     FailureReason = "name_resolution"
+	ReasonTlsHandshake       FailureReason = "tls_handshake"
+	ReasonHttpUnauthorized   FailureReason = "http_401"
+	ReasonHttpForbidden      FailureReason = "http_403"
+	ReasonHttpNon200         FailureReason = "http_non_200"
+	ReasonBadRcode           FailureReason = "bad_rcode"
+	ReasonAnswerMismatch     FailureReason = "answer_mismatch"
+	ReasonPacketLoss         FailureReason = "packet_loss" // часть ответов получена, но потери выше порога
+	ReasonRequestError       FailureReason = "request_error"
+	ReasonUnknown            FailureReason = "unknown"
+)
+
+// Функция определяет причину ошибки сетевого запроса (dns или http)
+func classifyError(err error) FailureReason {
+	if err == nil {
+		return ReasonNone
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return classifyHttpCode(statusErr.code)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ReasonNameResolution
+	}
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return ReasonTlsHandshake
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ReasonNetworkUnreachable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() {
+		if opErr.Op == "dial" {
+			return ReasonDialTimeout
+		}
+		return ReasonReadTimeout
+	}
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ReasonReadTimeout
+	}
+	return ReasonUnknown
+}
+
+// Функция определяет причину неудачного http ответа по коду
+func classifyHttpCode(code int) FailureReason {
+	switch code {
+	case 200:
+		return ReasonNone
+	case 401:
+		return ReasonHttpUnauthorized
+	case 403:
+		return ReasonHttpForbidden
+	default:
+		return ReasonHttpNon200
+	}
+}
+
+// Ошибка неуспешного http ответа там, где ответ разбирается как данные (DoH)
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected http status %s", err.status)
+}
@@ -0,0 +1,100 @@
+package pdns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Вывод в Graphite по протоколу plaintext через tcp: строки <путь> <значение> <время в секундах>
+// по умолчанию значения лейблов добавляются в путь по порядку имен лейблов, при GraphiteTags - передаются тегами (graphite 1.1+)
+const (
+	outputTypeGraphite      = "graphite"
+	defaultGraphiteTemplate = "{{.Prefix}}{{.Name}}{{range .LabelValues}}.{{.}}{{end}}"
+	defaultGraphiteTagged   = "{{.Prefix}}{{.Name}}"
+	graphiteDialTimeout     = 5 * time.Second
+	graphiteWriteTimeout    = 10 * time.Second
+)
+
+// в компонентах пути допустимы буквы, цифры, дефис и подчеркивание, остальные символы заменяются подчеркиванием
+func graphiteSanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// Формат plaintext, tagged - лейблы передаются тегами ;name=value
+type graphiteEncoder struct {
+	tagged bool
+}
+
+func newGraphiteOutput(settings OutputSettings, reloadInterval time.Duration) (outputParts, error) {
+	if settings.Address == "" {
+		return outputParts{}, fmt.Errorf("address is required for the %s output", outputTypeGraphite)
+	}
+	parts := outputParts{
+		encoder:  graphiteEncoder{tagged: settings.GraphiteTags},
+		writer:   &tcpOutputWriter{address: settings.Address},
+		template: defaultGraphiteTemplate,
+		sanitize: graphiteSanitize,
+	}
+	if settings.GraphiteTags {
+		parts.template = defaultGraphiteTagged
+	}
+	return parts, nil
+}
+
+// Функция кодирует отсчеты в строки plaintext, теги с пустым значением не передаются
+func (encoder graphiteEncoder) encode(samples []namedSample, at time.Time) []byte {
+	var lines strings.Builder
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	for _, sample := range samples {
+		if !finite(sample.Value) {
+			continue
+		}
+		lines.WriteString(sample.Name)
+		if encoder.tagged {
+			for _, label := range sample.Labels {
+				if label.Value != "" {
+					lines.WriteString(";" + graphiteSanitize(label.Name) + "=" + graphiteSanitize(label.Value))
+				}
+			}
+		}
+		lines.WriteString(" " + strconv.FormatFloat(sample.Value, 'g', -1, 64) + " " + timestamp + "\n")
+	}
+	return []byte(lines.String())
+}
+
+// Tcp доставка, соединение переиспользуется между циклами и открывается заново после ошибки
+type tcpOutputWriter struct {
+	address string
+	mu      sync.Mutex
+	conn    net.Conn
+}
+
+// Функция записывает данные в соединение, ошибки tcp всегда имеет смысл повторить
+func (writer *tcpOutputWriter) write(payload []byte) (bool, error) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if writer.conn == nil {
+		conn, err := net.DialTimeout("tcp", writer.address, graphiteDialTimeout)
+		if err != nil {
+			return true, err
+		}
+		writer.conn = conn
+	}
+	writer.conn.SetWriteDeadline(time.Now().Add(graphiteWriteTimeout))
+	if _, err := writer.conn.Write(payload); err != nil {
+		writer.conn.Close()
+		writer.conn = nil
+		return true, err
+	}
+	return false, nil
+}
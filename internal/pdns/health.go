@@ -0,0 +1,67 @@
+package pdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// true после того, как листенер экспортера начал принимать подключения
+var listenerUp atomic.Bool
+
+// Ответ эндпоинтов /-/healthy и /-/ready
+type healthResponse struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// через сколько интервалов опроса без завершенного цикла результаты считаются устаревшими
+const staleSnapshotIntervals = 3
+
+// Функция возвращает причины неготовности экспортера, пустой список - экспортер готов
+// готовность: конфиг загружен, листенер запущен, последний цикл опроса завершен не раньше staleSnapshotIntervals интервалов назад
+func readinessReasons() []string {
+	var reasons []string
+	if Config == nil || ConfErr != nil {
+		reasons = append(reasons, "config is not loaded")
+	}
+	if !listenerUp.Load() {
+		reasons = append(reasons, "listener is not up")
+	}
+	completed := GetSnapshot().Completed
+	switch {
+	case completed.IsZero():
+		reasons = append(reasons, "no probe cycle has completed yet")
+	case Config != nil && time.Since(completed) > staleSnapshotIntervals*time.Duration(Config.ProbeInterval)*time.Second:
+		reasons = append(reasons, fmt.Sprintf("the last probe cycle completed %s ago", time.Since(completed).Round(time.Second)))
+	}
+	return reasons
+}
+
+// Функция отвечает статусом в формате json
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	jsonResponse, _ := json.Marshal(response)
+	w.Write(jsonResponse)
+}
+
+// Обработчик /-/healthy, процесс жив и обрабатывает запросы
+func HealthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+}
+
+// Обработчик /-/ready, 503 с причинами, пока экспортер не готов
+func ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reasons := readinessReasons(); len(reasons) > 0 {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Reasons: reasons})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ready"})
+	})
+}
@@ -0,0 +1,38 @@
+package pdns
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessStaleSnapshot(t *testing.T) {
+	Config, ConfErr = &Conf{ProbeInterval: 2}, nil
+	listenerUp.Store(true)
+	t.Cleanup(func() {
+		Config = nil
+		listenerUp.Store(false)
+		snapshotMu.Lock()
+		lastSnapshot = ProbeSnapshot{}
+		snapshotMu.Unlock()
+	})
+	setCompleted := func(completed time.Time) {
+		snapshotMu.Lock()
+		lastSnapshot = ProbeSnapshot{Completed: completed}
+		snapshotMu.Unlock()
+	}
+
+	setCompleted(time.Now().Add(-3 * time.Second))
+	if reasons := readinessReasons(); len(reasons) != 0 {
+		t.Errorf("a fresh snapshot: reasons = %v, want ready", reasons)
+	}
+	setCompleted(time.Now().Add(-time.Minute))
+	reasons := readinessReasons()
+	if len(reasons) != 1 || !strings.Contains(reasons[0], "the last probe cycle completed") {
+		t.Errorf("a stale snapshot: reasons = %v, want not ready", reasons)
+	}
+	setCompleted(time.Time{})
+	if reasons := readinessReasons(); len(reasons) != 1 || reasons[0] != "no probe cycle has completed yet" {
+		t.Errorf("no snapshot: reasons = %v", reasons)
+	}
+}
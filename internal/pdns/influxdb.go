@@ -0,0 +1,60 @@
+package pdns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Вывод в InfluxDB по протоколу line protocol
+// URL - адрес записи, например https://influx:8086/api/v2/write?org=noc&bucket=dns для v2 или https://influx:8086/write?db=dns для v1
+// имя по шаблону - measurement, лейблы - теги, значение - поле value, время - в наносекундах
+const (
+	outputTypeInflux      = "influxdb"
+	defaultInfluxTemplate = "{{.Prefix}}{{.Name}}"
+)
+
+// экранирование line protocol: в measurement - запятые и пробелы, в тегах еще и знак равенства
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// Формат line protocol
+type influxEncoder struct{}
+
+func newInfluxOutput(settings OutputSettings, reloadInterval time.Duration) (outputParts, error) {
+	if settings.URL == "" {
+		return outputParts{}, fmt.Errorf("url is required for the %s output", outputTypeInflux)
+	}
+	client, err := newSinkHttpClient("output_"+settings.Name, settings.SinkHttpSettings, reloadInterval)
+	if err != nil {
+		return outputParts{}, err
+	}
+	return outputParts{
+		encoder:  influxEncoder{},
+		writer:   &httpOutputWriter{client: client, url: settings.URL, contentType: "text/plain; charset=utf-8", token: settings.Token},
+		template: defaultInfluxTemplate,
+	}, nil
+}
+
+// Функция кодирует отсчеты в строки measurement,tag=value value=<число> <время>, теги с пустым значением не передаются
+func (influxEncoder) encode(samples []namedSample, at time.Time) []byte {
+	var lines strings.Builder
+	timestamp := strconv.FormatInt(at.UnixNano(), 10)
+	for _, sample := range samples {
+		if !finite(sample.Value) {
+			continue
+		}
+		lines.WriteString(influxMeasurementEscaper.Replace(sample.Name))
+		for _, label := range sample.Labels {
+			if label.Value == "" {
+				continue
+			}
+			lines.WriteString("," + influxTagEscaper.Replace(label.Name) + "=" + influxTagEscaper.Replace(label.Value))
+		}
+		lines.WriteString(" value=" + strconv.FormatFloat(sample.Value, 'g', -1, 64) + " " + timestamp + "\n")
+	}
+	return []byte(lines.String())
+}
@@ -0,0 +1,76 @@
+package pdns
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Гистограммы времени ответа и счетчики смены состояний, накапливаются между скрейпами в фоновом опросе
+var (
+	recursorResponseTime          *prometheus.HistogramVec
+	authNodeResponseTime          *prometheus.HistogramVec
+	stateTransitionsSimpleCluster *prometheus.CounterVec
+	stateTransitionsRecursor      *prometheus.CounterVec
+	probeFailuresAuthNode         *prometheus.CounterVec
+	probeFailuresRecursor         *prometheus.CounterVec
+)
+
+// Функция создает метрики фонового опроса (гистограммы с бакетами из конфига и счетчики) и возвращает их для регистрации
+func initProbeMetrics(buckets []float64) []prometheus.Collector {
+	recursorResponseTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "response_time_Recursor_seconds",
+			Help:    "Распределение времени ответа апстрима или рекурсора в секундах",
+			Buckets: buckets,
+		},
+		[]string{"RecursorID", "family"},
+	)
+	authNodeResponseTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "response_time_auth_node_seconds",
+			Help:    "Распределение времени ответа ноды авторити кластера в секундах",
+			Buckets: buckets,
+		},
+		[]string{"cluster", "simplecluster", "node", "role", "family"},
+	)
+	stateTransitionsSimpleCluster = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "state_transitions_simple_cluster_total",
+			Help: "Количество смен состояния доступности кластера днс в составе большого кластера",
+		},
+		[]string{"cluster", "simplecluster"},
+	)
+	stateTransitionsRecursor = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "state_transitions_Recursor_total",
+			Help: "Количество смен состояния доступности апстрима или рекурсора",
+		},
+		[]string{"RecursorID", "family"},
+	)
+	probeFailuresAuthNode = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_failures_auth_node_total",
+			Help: "Количество неудачных проверок нод авторити кластера по причинам",
+		},
+		[]string{"cluster", "simplecluster", "node", "role", "family", "reason"},
+	)
+	probeFailuresRecursor = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_failures_Recursor_total",
+			Help: "Количество неудачных проверок апстрима или рекурсора по причинам",
+		},
+		[]string{"RecursorID", "family", "reason"},
+	)
+	return []prometheus.Collector{
+		recursorResponseTime, authNodeResponseTime,
+		stateTransitionsSimpleCluster, stateTransitionsRecursor,
+		probeFailuresAuthNode, probeFailuresRecursor,
+	}
+}
+
+// Перевод bool в значение метрики
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package pdns
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Лейбл отсчета метрики
+type labelPair struct {
+	Name  string
+	Value string
+}
+
+// Отсчет метрики из реестра для отправки во внешние системы (remote write, influxdb, graphite)
+// Family - имя семейства, Name - имя ряда (у гистограмм и сводок с суффиксами _bucket, _sum и _count)
+// Labels отсортированы по имени, как их отдает реестр
+type metricSample struct {
+	Family string
+	Name   string
+	Labels []labelPair
+	Value  float64
+}
+
+// Функция собирает метрики реестра и разворачивает их в отсчеты так же, как они выглядят на странице /metrics
+func gatherSamples(gatherer prometheus.Gatherer) ([]metricSample, error) {
+	families, err := gatherer.Gather()
+	var samples []metricSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			labels := make([]labelPair, 0, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, labelPair{Name: label.GetName(), Value: label.GetValue()})
+			}
+			add := func(suffix string, value float64, extra ...labelPair) {
+				samples = append(samples, metricSample{Family: name, Name: name + suffix, Labels: appendLabels(labels, extra...), Value: value})
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					add("_bucket", float64(bucket.GetCumulativeCount()), labelPair{Name: "le", Value: formatFloat(bucket.GetUpperBound())})
+				}
+				add("_bucket", float64(histogram.GetSampleCount()), labelPair{Name: "le", Value: "+Inf"})
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add("", quantile.GetValue(), labelPair{Name: "quantile", Value: formatFloat(quantile.GetQuantile())})
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			}
+		}
+	}
+	// реестр возвращает собранные метрики и при ошибке части коллекторов
+	return samples, err
+}
+
+// Функция возвращает копию лейблов с добавленными лейблами, порядок по имени сохраняется
+func appendLabels(labels []labelPair, extra ...labelPair) []labelPair {
+	result := make([]labelPair, 0, len(labels)+len(extra))
+	result = append(result, labels...)
+	for _, label := range extra {
+		i := len(result)
+		for i > 0 && result[i-1].Name > label.Name {
+			i--
+		}
+		result = append(result, labelPair{})
+		copy(result[i+1:], result[i:])
+		result[i] = label
+	}
+	return result
+}
+
+// Функция форматирует границу бакета или квантиль как в формате экспозиции prometheus
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,547 @@
+package pdns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Настройки экспорта в OpenTelemetry collector по OTLP/HTTP (кодировка json)
+// URL - базовый адрес приема, например http://otel-collector:4318, к нему добавляются /v1/metrics и /v1/traces
+// Signals - metrics (все метрики экспортера) и traces (трейс на каждый цикл опроса), пусто - оба
+// ResourceAttributes - атрибуты ресурса в дополнение к service.name, service.version и host.name
+// Headers - дополнительные заголовки запросов (например, идентификатор тенанта)
+type OtlpSettings struct {
+	URL                string            `json:"url" validate:"omitempty,url"`
+	Signals            []string          `json:"signals" validate:"dive,oneof=metrics traces"`
+	ResourceAttributes map[string]string `json:"resourceAttributes"`
+	Headers            map[string]string `json:"headers"`
+	SinkHttpSettings
+}
+
+// Сигналы OTLP
+const (
+	otlpSignalMetrics = "metrics"
+	otlpSignalTraces  = "traces"
+)
+
+// Значения перечислений OTLP
+const (
+	otlpTemporalityCumulative = 2
+	otlpSpanKindInternal      = 1
+	otlpSpanKindClient        = 3
+	otlpStatusOk              = 1
+	otlpStatusError           = 2
+)
+
+// имя сервиса и области инструментирования в OTLP
+const otlpServiceName = "group-dns-exporter"
+
+// время запуска экспортера, начало накопления счетчиков и гистограмм
+var exporterStarted = time.Now()
+
+// Метрики экспорта OTLP, result - success или failure
+var otlpExports = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "otlp_exports_total",
+		Help: "Количество отправок в OpenTelemetry collector по сигналу и результату",
+	},
+	[]string{"signal", "result"},
+)
+
+// Структуры OTLP/JSON, 64-битные целые кодируются строками, идентификаторы трейсов и спанов - в hex
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpNumberPoint struct {
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+	StartTime  string          `json:"startTimeUnixNano,omitempty"`
+	Time       string          `json:"timeUnixNano"`
+	Value      float64         `json:"asDouble"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes     []otlpAttribute `json:"attributes,omitempty"`
+	StartTime      string          `json:"startTimeUnixNano"`
+	Time           string          `json:"timeUnixNano"`
+	Count          string          `json:"count"`
+	Sum            float64         `json:"sum"`
+	BucketCounts   []string        `json:"bucketCounts"`
+	ExplicitBounds []float64       `json:"explicitBounds"`
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpSummaryPoint struct {
+	Attributes     []otlpAttribute `json:"attributes,omitempty"`
+	StartTime      string          `json:"startTimeUnixNano"`
+	Time           string          `json:"timeUnixNano"`
+	Count          string          `json:"count"`
+	Sum            float64         `json:"sum"`
+	QuantileValues []otlpQuantile  `json:"quantileValues"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints  []otlpNumberPoint `json:"dataPoints"`
+	Temporality int               `json:"aggregationTemporality"`
+	Monotonic   bool              `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints  []otlpHistogramPoint `json:"dataPoints"`
+	Temporality int                  `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// Функции создания атрибутов
+func stringAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttribute {
+	encoded := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpAnyValue{IntValue: &encoded}}
+}
+
+func doubleAttr(key string, value float64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{DoubleValue: &value}}
+}
+
+func boolAttr(key string, value bool) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{BoolValue: &value}}
+}
+
+// Функция возвращает время в наносекундах unix для OTLP/JSON
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Функция возвращает случайный идентификатор трейса (16 байт) или спана (8 байт) в hex
+func otlpID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Экспортер OTLP, после каждого цикла опроса отправляет метрики реестра и трейс цикла
+type otlpSink struct {
+	settings OtlpSettings
+	client   *sinkHttpClient
+	gatherer prometheus.Gatherer
+	resource otlpResource
+	scope    otlpScope
+	metrics  bool
+	traces   bool
+	cycles   chan ProbeSnapshot
+}
+
+// Функция создает экспортер OTLP и запускает отправку
+func newOtlpSink(settings OtlpSettings, reg prometheus.Gatherer, reloadInterval time.Duration) (*otlpSink, error) {
+	client, err := newSinkHttpClient("otlp", settings.SinkHttpSettings, reloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	version, _ := buildInfo()
+	signals := listToSet(settings.Signals)
+	sink := &otlpSink{
+		settings: settings,
+		client:   client,
+		gatherer: reg,
+		scope:    otlpScope{Name: otlpServiceName, Version: version},
+		metrics:  passFilter(signals, otlpSignalMetrics),
+		traces:   passFilter(signals, otlpSignalTraces),
+		cycles:   make(chan ProbeSnapshot, 1),
+	}
+	attributes := map[string]string{"service.name": otlpServiceName, "service.version": version}
+	if hostname, err := os.Hostname(); err == nil {
+		attributes["host.name"] = hostname
+	}
+	for name, value := range settings.ResourceAttributes {
+		attributes[name] = value
+	}
+	for name, value := range attributes {
+		sink.resource.Attributes = append(sink.resource.Attributes, stringAttr(name, value))
+	}
+	go sink.run()
+	return sink, nil
+}
+
+// Функция передает результаты цикла на отправку, если предыдущий цикл еще не отправлен, он заменяется
+func (sink *otlpSink) HandleCycle(snapshot ProbeSnapshot) {
+	select {
+	case <-sink.cycles:
+	default:
+	}
+	sink.cycles <- snapshot
+}
+
+// Функция отправляет метрики и трейс каждого цикла, при ошибке данные цикла не повторяются:
+// счетчики и гистограммы накопительные, следующая отправка их восполнит
+func (sink *otlpSink) run() {
+	for snapshot := range sink.cycles {
+		if sink.metrics {
+			sink.export(otlpSignalMetrics, sink.metricsRequest(snapshot.Completed))
+		}
+		if sink.traces {
+			sink.export(otlpSignalTraces, sink.tracesRequest(snapshot))
+		}
+	}
+}
+
+// Функция отправляет запрос сигнала в collector
+func (sink *otlpSink) export(signal string, request any) {
+	payload, err := json.Marshal(request)
+	if err == nil {
+		err = sink.client.do("POST", strings.TrimRight(sink.settings.URL, "/")+"/v1/"+signal, "application/json", payload, sink.settings.Headers)
+	}
+	if err != nil {
+		otlpExports.WithLabelValues(signal, "failure").Inc()
+		slog.Error(fmt.Sprintf("Error exporting %s to the OpenTelemetry collector: %s", signal, err))
+		return
+	}
+	otlpExports.WithLabelValues(signal, "success").Inc()
+}
+
+// Функция собирает метрики реестра и переводит их в OTLP: gauge и untyped - gauge, counter - монотонная накопительная сумма,
+// histogram и summary - накопительные гистограмма и сводка; значения NaN и Inf в json непредставимы и пропускаются,
+// точки гистограммы и сводки с такой суммой пропускаются целиком
+func (sink *otlpSink) metricsRequest(now time.Time) otlpMetricsRequest {
+	families, err := sink.gatherer.Gather()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error gathering metrics for OTLP: %s", err))
+	}
+	timestamp, started := unixNano(now), unixNano(exporterStarted)
+	var metrics []otlpMetric
+	for _, family := range families {
+		metric := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{Temporality: otlpTemporalityCumulative, Monotonic: true}
+		case dto.MetricType_HISTOGRAM:
+			metric.Histogram = &otlpHistogram{Temporality: otlpTemporalityCumulative}
+		case dto.MetricType_SUMMARY:
+			metric.Summary = &otlpSummary{}
+		default:
+			metric.Gauge = &otlpGauge{}
+		}
+		for _, m := range family.GetMetric() {
+			attributes := otlpLabels(m.GetLabel())
+			switch {
+			case metric.Sum != nil:
+				if finite(m.GetCounter().GetValue()) {
+					metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberPoint{Attributes: attributes, StartTime: started, Time: timestamp, Value: m.GetCounter().GetValue()})
+				}
+			case metric.Histogram != nil:
+				if finite(m.GetHistogram().GetSampleSum()) {
+					metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramFrom(m.GetHistogram(), attributes, started, timestamp))
+				}
+			case metric.Summary != nil:
+				if !finite(m.GetSummary().GetSampleSum()) {
+					continue
+				}
+				point := otlpSummaryPoint{Attributes: attributes, StartTime: started, Time: timestamp,
+					Count: strconv.FormatUint(m.GetSummary().GetSampleCount(), 10), Sum: m.GetSummary().GetSampleSum()}
+				for _, quantile := range m.GetSummary().GetQuantile() {
+					if finite(quantile.GetValue()) {
+						point.QuantileValues = append(point.QuantileValues, otlpQuantile{Quantile: quantile.GetQuantile(), Value: quantile.GetValue()})
+					}
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+			default:
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				if finite(value) {
+					metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberPoint{Attributes: attributes, Time: timestamp, Value: value})
+				}
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     sink.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: sink.scope, Metrics: metrics}},
+	}}}
+}
+
+// Функция переводит лейблы метрики в атрибуты
+func otlpLabels(labels []*dto.LabelPair) []otlpAttribute {
+	var attributes []otlpAttribute
+	for _, label := range labels {
+		attributes = append(attributes, stringAttr(label.GetName(), label.GetValue()))
+	}
+	return attributes
+}
+
+// Функция переводит гистограмму prometheus (накопительные бакеты) в OTLP (количество в каждом бакете, последний - до +Inf)
+func otlpHistogramFrom(histogram *dto.Histogram, attributes []otlpAttribute, started, timestamp string) otlpHistogramPoint {
+	point := otlpHistogramPoint{
+		Attributes:     attributes,
+		StartTime:      started,
+		Time:           timestamp,
+		Count:          strconv.FormatUint(histogram.GetSampleCount(), 10),
+		Sum:            histogram.GetSampleSum(),
+		ExplicitBounds: []float64{},
+	}
+	var previous uint64
+	for _, bucket := range histogram.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-previous, 10))
+		previous = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(histogram.GetSampleCount()-previous, 10))
+	return point
+}
+
+// Функция проверяет, что значение представимо в json
+func finite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// Функция строит трейс цикла опроса: корневой спан цикла, спаны больших кластеров, вложенные спаны маленьких кластеров
+// и спаны проверок нод, а также спаны проверок рекурсоров непосредственно под корневым
+func (sink *otlpSink) tracesRequest(snapshot ProbeSnapshot) otlpTracesRequest {
+	traceID := otlpID(16)
+	root := otlpSpan{
+		TraceID:   traceID,
+		SpanID:    otlpID(8),
+		Name:      "probe cycle",
+		Kind:      otlpSpanKindInternal,
+		StartTime: unixNano(snapshot.Started),
+		EndTime:   unixNano(snapshot.Completed),
+		Attributes: []otlpAttribute{
+			intAttr("dns.groups", int64(len(snapshot.Megaclusters))),
+			intAttr("dns.recursor_probes", int64(len(snapshot.Recursors))),
+		},
+		Status: otlpStatus{Code: otlpStatusOk},
+	}
+	spans := []otlpSpan{root}
+	for _, megacluster := range snapshot.Megaclusters {
+		verdict := megaclusterVerdict(megacluster)
+		group := otlpSpan{
+			TraceID:      traceID,
+			SpanID:       otlpID(8),
+			ParentSpanID: root.SpanID,
+			Name:         "group " + megacluster.MegaClusterID,
+			Kind:         otlpSpanKindInternal,
+			StartTime:    unixNano(megacluster.Started),
+			EndTime:      unixNano(megacluster.Completed),
+			Attributes: []otlpAttribute{
+				stringAttr("dns.group.id", megacluster.MegaClusterID),
+				stringAttr("dns.group.verdict", verdict),
+				intAttr("dns.group.clusters", int64(megacluster.AllSimpleClusters)),
+				intAttr("dns.group.available_clusters", int64(megacluster.AvailabileSimpleClusters)),
+				intAttr("dns.group.maintenance_clusters", int64(megacluster.MaintenanceSimpleClusters)),
+			},
+			Status: otlpStatus{Code: otlpStatusOk},
+		}
+		if verdict == verdictDown {
+			group.Status = otlpStatus{Code: otlpStatusError, Message: "all clusters of the group are unavailable"}
+		}
+		spans = append(spans, group)
+		for _, simplecluster := range megacluster.SimpleClusters {
+			cluster := otlpSpan{
+				TraceID:      traceID,
+				SpanID:       otlpID(8),
+				ParentSpanID: group.SpanID,
+				Name:         "cluster " + simplecluster.ClusterID,
+				Kind:         otlpSpanKindInternal,
+				StartTime:    unixNano(simplecluster.Started),
+				EndTime:      unixNano(simplecluster.Completed),
+				Attributes: []otlpAttribute{
+					stringAttr("dns.group.id", megacluster.MegaClusterID),
+					stringAttr("dns.cluster.id", simplecluster.ClusterID),
+					boolAttr("dns.cluster.available", simplecluster.Availability),
+					boolAttr("dns.cluster.last_probe_ok", simplecluster.RawAvailability),
+					boolAttr("dns.cluster.maintenance", simplecluster.Maintenance),
+				},
+				Status: otlpStatus{Code: otlpStatusOk},
+			}
+			if !simplecluster.RawAvailability {
+				cluster.Status = otlpStatus{Code: otlpStatusError, Message: nodesFailure(simplecluster.Nodes)}
+			}
+			spans = append(spans, cluster)
+			for _, node := range simplecluster.Nodes {
+				spans = append(spans, authNodeSpan(traceID, cluster.SpanID, node))
+			}
+		}
+	}
+	for _, recursor := range snapshot.Recursors {
+		spans = append(spans, recursorSpan(traceID, root.SpanID, recursor))
+	}
+	return otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   sink.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: sink.scope, Spans: spans}},
+	}}}
+}
+
+// Функция возвращает спан проверки ноды: серии dns запросов для master и slave, http запроса для balancer
+func authNodeSpan(traceID, parentID string, node AvailabilityAuthNode) otlpSpan {
+	span := probeSpan(traceID, parentID, node.ProbedAt, node.Duration, node.Availability, node.FailureReason, node.FailureDetail)
+	span.Attributes = append(span.Attributes,
+		stringAttr("dns.node.address", node.Address),
+		stringAttr("dns.node.role", node.Role),
+		stringAttr("server.address", node.IP),
+		stringAttr("network.type", node.Family),
+	)
+	if node.Role == roleBalancer {
+		span.Name = "http probe " + node.Address
+		if node.HttpCode != 0 {
+			span.Attributes = append(span.Attributes, intAttr("http.response.status_code", int64(node.HttpCode)))
+		}
+		return span
+	}
+	span.Name = "dns probe " + node.Address
+	span.Attributes = append(span.Attributes, probeStatsAttrs(node.Rcode, node.SampleStats)...)
+	return span
+}
+
+// Функция возвращает спан проверки рекурсора
+func recursorSpan(traceID, parentID string, recursor AvailabilityRecursor) otlpSpan {
+	span := probeSpan(traceID, parentID, recursor.ProbedAt, recursor.Duration, recursor.RawAvailability, recursor.FailureReason, recursor.FailureDetail)
+	span.Name = "dns probe recursor " + recursor.RecursorID
+	span.Attributes = append(span.Attributes,
+		stringAttr("dns.recursor.id", recursor.RecursorID),
+		boolAttr("dns.recursor.available", recursor.Availability),
+		stringAttr("server.address", recursor.Address),
+		stringAttr("network.type", recursor.Family),
+	)
+	span.Attributes = append(span.Attributes, probeStatsAttrs(recursor.Rcode, recursor.SampleStats)...)
+	return span
+}
+
+// Функция возвращает спан проверки с результатом и причиной отказа
+func probeSpan(traceID, parentID string, started time.Time, duration time.Duration, available bool, reason FailureReason, detail string) otlpSpan {
+	span := otlpSpan{
+		TraceID:      traceID,
+		SpanID:       otlpID(8),
+		ParentSpanID: parentID,
+		Kind:         otlpSpanKindClient,
+		StartTime:    unixNano(started),
+		EndTime:      unixNano(started.Add(duration)),
+		Attributes:   []otlpAttribute{boolAttr("dns.probe.ok", available)},
+		Status:       otlpStatus{Code: otlpStatusOk},
+	}
+	if !available {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: fmt.Sprintf("%s: %s", reason, detail)}
+		span.Attributes = append(span.Attributes, stringAttr("dns.probe.failure_reason", string(reason)))
+	}
+	return span
+}
+
+// Функция возвращает атрибуты серии dns запросов: rcode, время ответа и потери
+func probeStatsAttrs(rcode int8, stats SampleStats) []otlpAttribute {
+	attributes := []otlpAttribute{
+		intAttr("dns.probe.sent", int64(stats.Sent)),
+		intAttr("dns.probe.received", int64(stats.Received)),
+		doubleAttr("dns.probe.packet_loss", stats.PacketLoss),
+	}
+	if name := rcodeName(rcode); name != "" {
+		attributes = append(attributes, stringAttr("dns.rcode", name))
+	}
+	if stats.Received > 0 {
+		attributes = append(attributes,
+			doubleAttr("dns.probe.latency_seconds", stats.AvgTTR.Seconds()),
+			doubleAttr("dns.probe.latency_min_seconds", stats.MinTTR.Seconds()),
+			doubleAttr("dns.probe.latency_max_seconds", stats.MaxTTR.Seconds()),
+			doubleAttr("dns.probe.jitter_seconds", stats.Jitter.Seconds()),
+		)
+	}
+	return attributes
+}
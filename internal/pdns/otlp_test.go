@@ -0,0 +1,42 @@
+package pdns
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOtlpMetricsNonFiniteSum(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_histogram", Buckets: []float64{1}}, []string{"case"})
+	summary := prometheus.NewSummaryVec(prometheus.SummaryOpts{Name: "test_summary", Objectives: map[float64]float64{0.5: 0.05}}, []string{"case"})
+	reg.MustRegister(histogram, summary)
+	for name, value := range map[string]float64{"finite": 0.5, "nan": math.NaN(), "inf": math.Inf(1)} {
+		histogram.WithLabelValues(name).Observe(value)
+		summary.WithLabelValues(name).Observe(value)
+	}
+
+	request := (&otlpSink{gatherer: reg}).metricsRequest(time.Now())
+	if _, err := json.Marshal(request); err != nil {
+		t.Fatalf("the request with non-finite sums must be encodable: %s", err)
+	}
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		var points [][]otlpAttribute
+		switch {
+		case metric.Histogram != nil:
+			for _, point := range metric.Histogram.DataPoints {
+				points = append(points, point.Attributes)
+			}
+		case metric.Summary != nil:
+			for _, point := range metric.Summary.DataPoints {
+				points = append(points, point.Attributes)
+			}
+		}
+		if len(points) != 1 || len(points[0]) != 1 || *points[0][0].Value.StringValue != "finite" {
+			t.Errorf("%s: points %+v, want only the point with a finite sum", metric.Name, points)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package pdns
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Настройки вывода результатов циклов опроса во внешнюю систему
+// Type - тип вывода (influxdb, graphite), URL - адрес записи для http выводов, Address - host:port для tcp выводов
+// Token - токен InfluxDB (заголовок Authorization: Token), литерал или ссылка env:, file:, exec:, vault:
+// Metrics - имена метрик результатов опроса для вывода, пусто - все
+// Prefix и NameTemplate - именование: шаблон text/template с полями Prefix, Name, Labels и LabelValues
+// Tags - лейблы, добавляемые ко всем отсчетам, GraphiteTags - лейблы graphite передаются тегами, а не в пути
+// Retries - количество повторов записи при ошибке сети, 429 или 5xx
+type OutputSettings struct {
+	Name         string            `json:"name" validate:"required"`
+	Type         string            `json:"type" validate:"required,oneof=influxdb graphite"`
+	URL          string            `json:"url" validate:"omitempty,url"`
+	Address      string            `json:"address" validate:"omitempty,hostname_port"`
+	Token        Secret            `json:"token"`
+	Metrics      []string          `json:"metrics"`
+	Prefix       string            `json:"prefix"`
+	NameTemplate string            `json:"nameTemplate"`
+	Tags         map[string]string `json:"tags"`
+	GraphiteTags bool              `json:"graphiteTags"`
+	Retries      *int              `json:"retries" validate:"omitempty,gte=0"`
+	SinkHttpSettings
+}
+
+// Значения по умолчанию для выводов
+const (
+	defaultOutputRetries = 3
+	outputBackoffStart   = time.Second
+	outputBackoffMax     = 30 * time.Second
+	// очередь записей вывода, при переполнении записи отбрасываются
+	outputQueueSize = 10
+)
+
+// Функция возвращает секреты вывода для разрешения и обновления вместе с остальными секретами конфига
+func (settings OutputSettings) secrets() []Secret {
+	return append(settings.SinkHttpSettings.secrets(), settings.Token)
+}
+
+// Метрики записи в выводы, result - success, failure или dropped
+var outputWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "output_writes_total",
+		Help: "Количество записей результатов цикла опроса в выводы по выводу и результату",
+	},
+	[]string{"output", "result"},
+)
+
+// Формат вывода: кодирует отсчеты цикла с именами по шаблону в тело записи
+type outputEncoder interface {
+	encode(samples []namedSample, at time.Time) []byte
+}
+
+// Доставка вывода: записывает тело во внешнюю систему, retry - ошибку имеет смысл повторить
+type outputWriter interface {
+	write(payload []byte) (retry bool, err error)
+}
+
+// Части вывода, которые задает его тип
+// template - шаблон имени по умолчанию, sanitize - очистка значений лейблов для шаблона имени (nil - без изменений)
+type outputParts struct {
+	encoder  outputEncoder
+	writer   outputWriter
+	template string
+	sanitize func(string) string
+}
+
+// Конструктор частей вывода по типу
+type outputFactory func(settings OutputSettings, reloadInterval time.Duration) (outputParts, error)
+
+// Типы выводов, новый тип добавляется конструктором здесь и значением в oneof поля Type
+var outputTypes = map[string]outputFactory{
+	outputTypeInflux:   newInfluxOutput,
+	outputTypeGraphite: newGraphiteOutput,
+}
+
+// Данные шаблона имени: Labels - лейблы по имени, LabelValues - значения лейблов в порядке имен
+type outputNameData struct {
+	Prefix      string
+	Name        string
+	Labels      map[string]string
+	LabelValues []string
+}
+
+// Отсчет с именем, построенным по шаблону вывода
+type namedSample struct {
+	Name   string
+	Labels []labelPair
+	Value  float64
+}
+
+// Вывод результатов циклов опроса, общий для всех типов: фильтр метрик, именование, очередь и повторы записи
+type outputSink struct {
+	settings OutputSettings
+	gatherer prometheus.Gatherer
+	encoder  outputEncoder
+	writer   outputWriter
+	naming   *template.Template
+	metrics  map[string]bool
+	tags     []labelPair
+	retries  int
+	sanitize func(string) string
+	queue    chan []byte
+}
+
+// Функция создает вывод по типу из настроек и запускает запись
+func newOutputSink(settings OutputSettings, gatherer prometheus.Gatherer, reloadInterval time.Duration) (*outputSink, error) {
+	factory, ok := outputTypes[settings.Type]
+	if !ok {
+		return nil, fmt.Errorf("output %s: unknown type %s", settings.Name, settings.Type)
+	}
+	parts, err := factory(settings, reloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("output %s: %w", settings.Name, err)
+	}
+	text := settings.NameTemplate
+	if text == "" {
+		text = parts.template
+	}
+	naming, err := template.New(settings.Name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("output %s: %w", settings.Name, err)
+	}
+	sink := &outputSink{
+		settings: settings,
+		gatherer: gatherer,
+		encoder:  parts.encoder,
+		writer:   parts.writer,
+		naming:   naming,
+		metrics:  listToSet(settings.Metrics),
+		retries:  defaultOutputRetries,
+		sanitize: parts.sanitize,
+		queue:    make(chan []byte, outputQueueSize),
+	}
+	if sink.sanitize == nil {
+		sink.sanitize = func(value string) string { return value }
+	}
+	if settings.Retries != nil {
+		sink.retries = *settings.Retries
+	}
+	for name, value := range settings.Tags {
+		sink.tags = append(sink.tags, labelPair{Name: name, Value: value})
+	}
+	sort.Slice(sink.tags, func(i, j int) bool { return sink.tags[i].Name < sink.tags[j].Name })
+	go sink.run()
+	return sink, nil
+}
+
+// Функция собирает результаты цикла, именует отсчеты и ставит запись в очередь
+func (sink *outputSink) HandleCycle(snapshot ProbeSnapshot) {
+	samples, err := gatherSamples(sink.gatherer)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error gathering metrics for the output %s: %s", sink.settings.Name, err))
+	}
+	var named []namedSample
+	for _, sample := range samples {
+		if !passFilter(sink.metrics, sample.Family) {
+			continue
+		}
+		labels := sample.Labels
+		for _, tag := range sink.tags {
+			if !hasLabel(labels, tag.Name) {
+				labels = appendLabels(labels, tag)
+			}
+		}
+		name, err := sink.name(sample.Name, labels)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error naming the metric %s for the output %s: %s", sample.Name, sink.settings.Name, err))
+			continue
+		}
+		named = append(named, namedSample{Name: name, Labels: labels, Value: sample.Value})
+	}
+	select {
+	case sink.queue <- sink.encoder.encode(named, snapshot.Completed):
+	default:
+		outputWrites.WithLabelValues(sink.settings.Name, "dropped").Inc()
+		slog.Error(fmt.Sprintf("The queue of the output %s is full, the probe cycle results are dropped", sink.settings.Name))
+	}
+}
+
+// Функция строит имя отсчета по шаблону вывода
+func (sink *outputSink) name(name string, labels []labelPair) (string, error) {
+	data := outputNameData{Prefix: sink.settings.Prefix, Name: name, Labels: make(map[string]string)}
+	for _, label := range labels {
+		data.Labels[label.Name] = sink.sanitize(label.Value)
+		data.LabelValues = append(data.LabelValues, sink.sanitize(label.Value))
+	}
+	var rendered bytes.Buffer
+	if err := sink.naming.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rendered.String()), nil
+}
+
+// Функция записывает результаты циклов по очереди, при ошибке повторяет запись с экспоненциальной паузой
+func (sink *outputSink) run() {
+	for payload := range sink.queue {
+		backoff := outputBackoffStart
+		for attempt := 0; ; attempt++ {
+			retry, err := sink.writer.write(payload)
+			if err == nil {
+				outputWrites.WithLabelValues(sink.settings.Name, "success").Inc()
+				break
+			}
+			if !retry || attempt >= sink.retries {
+				outputWrites.WithLabelValues(sink.settings.Name, "failure").Inc()
+				slog.Error(fmt.Sprintf("Error writing the probe cycle results to the output %s: %s", sink.settings.Name, err))
+				break
+			}
+			slog.Warn(fmt.Sprintf("Error writing to the output %s, retry in %s: %s", sink.settings.Name, backoff, err))
+			time.Sleep(backoff)
+			backoff = min(backoff*2, outputBackoffMax)
+		}
+	}
+}
+
+// Http доставка для выводов, принимающих запись запросом POST
+// token - токен InfluxDB, берется на каждую запись, чтобы учитывать его обновление
+type httpOutputWriter struct {
+	client      *sinkHttpClient
+	url         string
+	contentType string
+	token       Secret
+}
+
+func (writer *httpOutputWriter) write(payload []byte) (bool, error) {
+	var headers map[string]string
+	if writer.token.Value() != "" {
+		headers = map[string]string{"Authorization": "Token " + writer.token.Value()}
+	}
+	err := writer.client.do("POST", writer.url, writer.contentType, payload, headers)
+	return err != nil && retryableSinkError(err), err
+}
@@ -0,0 +1,57 @@
+package pdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// Сведения о сертификате, предъявленном опрашиваемым сервером по tls (https апи, DoT и DoH)
+// для цепочки - сертификат, который истекает раньше остальных (лист, промежуточный или корневой)
+type PeerCert struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// Функция возвращает сведения о сертификате цепочки сервера с ближайшим окончанием действия, nil - соединение без tls
+// цепочка берется проверенная (с корневым сертификатом из доверенных), если ее нет - предъявленная сервером
+func newPeerCert(state *tls.ConnectionState) *PeerCert {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	earliest := chain[0]
+	for _, cert := range chain[1:] {
+		if cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+	info := certInfo(earliest)
+	return &info
+}
+
+// Функция возвращает CN, если он задан, иначе полное имя
+func certName(commonName, full string) string {
+	if commonName != "" {
+		return commonName
+	}
+	return full
+}
+
+// Функция возвращает число дней до окончания действия сертификата, отрицательное - сертификат истек
+func daysRemaining(notAfter time.Time) float64 {
+	return time.Until(notAfter).Hours() / 24
+}
+
+// Функция возвращает сведения о сертификате: CN (или полное имя) субъекта и издателя, время окончания действия
+func certInfo(cert *x509.Certificate) PeerCert {
+	return PeerCert{
+		Subject:  certName(cert.Subject.CommonName, cert.Subject.String()),
+		Issuer:   certName(cert.Issuer.CommonName, cert.Issuer.String()),
+		NotAfter: cert.NotAfter,
+	}
+}
@@ -0,0 +1,49 @@
+package pdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func testCert(subject, issuer string, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:  pkix.Name{CommonName: subject},
+		Issuer:   pkix.Name{CommonName: issuer},
+		NotAfter: notAfter,
+	}
+}
+
+func TestNewPeerCertEarliestInChain(t *testing.T) {
+	now := time.Now()
+	leaf := testCert("dns.example.com", "intermediate", now.Add(90*24*time.Hour))
+	intermediate := testCert("intermediate", "root", now.Add(10*24*time.Hour))
+	root := testCert("root", "root", now.Add(5*24*time.Hour))
+
+	// предъявленная цепочка: промежуточный сертификат истекает раньше листа
+	got := newPeerCert(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, intermediate}})
+	if got == nil || got.Subject != "intermediate" || got.Issuer != "root" || !got.NotAfter.Equal(intermediate.NotAfter) {
+		t.Errorf("presented chain: got %+v, want the intermediate certificate", got)
+	}
+
+	// проверенная цепочка включает корневой сертификат из доверенных
+	got = newPeerCert(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, intermediate},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, intermediate, root}},
+	})
+	if got == nil || got.Subject != "root" || !got.NotAfter.Equal(root.NotAfter) {
+		t.Errorf("verified chain: got %+v, want the root certificate", got)
+	}
+
+	// при одинаковом сроке остается лист
+	got = newPeerCert(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, testCert("intermediate", "root", leaf.NotAfter)}})
+	if got == nil || got.Subject != "dns.example.com" {
+		t.Errorf("equal expiry: got %+v, want the leaf certificate", got)
+	}
+
+	if newPeerCert(nil) != nil || newPeerCert(&tls.ConnectionState{}) != nil {
+		t.Errorf("a connection without certificates must not have a peer cert")
+	}
+}
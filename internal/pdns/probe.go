@@ -0,0 +1,79 @@
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Снимок результатов последнего цикла опроса, из него коллектор отдает метрики при скрейпе
+// Started и Completed - время начала и окончания цикла
+type ProbeSnapshot struct {
+	Megaclusters []AvailabilityMegacluster
+	Recursors    []AvailabilityRecursor
+	Started      time.Time
+	Completed    time.Time
+}
+
+var (
+	snapshotMu   sync.RWMutex
+	lastSnapshot ProbeSnapshot
+)
+
+// Получатель результатов цикла опроса (уведомления, внешние хранилища метрик)
+// HandleCycle вызывается после каждого цикла и не должен надолго его задерживать
+type CycleSink interface {
+	HandleCycle(snapshot ProbeSnapshot)
+}
+
+// получатели результатов, добавляются при запуске до начала опроса
+var cycleSinks []CycleSink
+
+// Функция добавляет получателя результатов цикла опроса
+func addCycleSink(sink CycleSink) {
+	cycleSinks = append(cycleSinks, sink)
+}
+
+// Функция возвращает результаты последнего завершенного цикла опроса
+func GetSnapshot() ProbeSnapshot {
+	snapshotMu.RLock()
+	defer snapshotMu.RUnlock()
+	return lastSnapshot
+}
+
+// Функция выполняет один цикл опроса авторити кластеров и рекурсоров и сохраняет результат
+func RunProbeCycle(conf *Conf) {
+	start := time.Now()
+	chAvailMgcl := make(chan []AvailabilityMegacluster)
+	chAvailUpstr := make(chan []AvailabilityRecursor)
+	defer close(chAvailMgcl)
+	defer close(chAvailUpstr)
+	go CheckAvailabilityAuth(conf.AuthClusters, conf.MtlsRequest, chAvailMgcl)
+	go CheckAvailabilityRecursor(conf.RecursorServers, chAvailUpstr)
+	snapshot := ProbeSnapshot{
+		Megaclusters: <-chAvailMgcl,
+		Recursors:    <-chAvailUpstr,
+		Started:      start,
+		Completed:    time.Now(),
+	}
+	snapshotMu.Lock()
+	lastSnapshot = snapshot
+	snapshotMu.Unlock()
+	probeCycleDuration.Set(snapshot.Completed.Sub(start).Seconds())
+	probeCycleLast.Set(float64(snapshot.Completed.Unix()))
+	for _, sink := range cycleSinks {
+		sink.HandleCycle(snapshot)
+	}
+	slog.Debug(fmt.Sprintf("The probe cycle has been completed in %s", time.Since(start)))
+}
+
+// Функция запускает фоновый опрос с интервалом из конфига, первый цикл выполняется сразу
+func RunProbeLoop(conf *Conf) {
+	ticker := time.NewTicker(time.Duration(conf.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		RunProbeCycle(conf)
+		<-ticker.C
+	}
+}
@@ -0,0 +1,115 @@
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Настройки отправки метрик в Pushgateway для сегментов, где prometheus не может опросить экспортер
+// URL - адрес pushgateway, Job - имя job группы метрик
+// Grouping - ключи группировки, по умолчанию instance=<имя хоста>, чтобы экспортеры не перезаписывали метрики друг друга
+// метрики отправляются после каждого цикла опроса, при штатной остановке группа удаляется из pushgateway
+type PushgatewaySettings struct {
+	URL      string            `json:"url" validate:"omitempty,url"`
+	Job      string            `json:"job"`
+	Grouping map[string]string `json:"grouping"`
+	SinkHttpSettings
+}
+
+// имя job по умолчанию для pushgateway и remote write
+const defaultExporterJob = "group-dns-exporter"
+
+// Метрики отправки в pushgateway, result - success или failure
+var pushgatewayPushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pushgateway_pushes_total",
+		Help: "Количество отправок метрик в pushgateway по результату",
+	},
+	[]string{"result"},
+)
+
+// Отправитель метрик в pushgateway, получает сигнал после каждого цикла опроса
+// stopped - группа удалена при остановке, после этого метрики не отправляются
+type pushgatewaySink struct {
+	mu      sync.Mutex
+	pusher  *push.Pusher
+	signal  chan struct{}
+	stopped bool
+}
+
+// Функция создает отправителя метрик реестра экспортера и запускает отправку
+func newPushgatewaySink(settings PushgatewaySettings, reg prometheus.Gatherer, reloadInterval time.Duration) (*pushgatewaySink, error) {
+	client, err := newSinkHttpClient("pushgateway", settings.SinkHttpSettings, reloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	job := settings.Job
+	if job == "" {
+		job = defaultExporterJob
+	}
+	grouping := settings.Grouping
+	if len(grouping) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("pushgateway: %w", err)
+		}
+		grouping = map[string]string{"instance": hostname}
+	}
+	pusher := push.New(settings.URL, job).Gatherer(reg).Client(client)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	sink := &pushgatewaySink{
+		pusher: pusher,
+		signal: make(chan struct{}, 1),
+	}
+	go sink.run()
+	return sink, nil
+}
+
+// Функция сообщает об окончании цикла, если предыдущая отправка еще идет, метрики отправятся один раз после нее
+func (sink *pushgatewaySink) HandleCycle(ProbeSnapshot) {
+	select {
+	case sink.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Функция отправляет метрики методом PUT, группа в pushgateway целиком заменяется текущими метриками
+// при ошибке метрики отправятся после следующего цикла опроса
+func (sink *pushgatewaySink) run() {
+	for range sink.signal {
+		sink.mu.Lock()
+		if sink.stopped {
+			sink.mu.Unlock()
+			return
+		}
+		err := sink.pusher.Push()
+		sink.mu.Unlock()
+		if err != nil {
+			pushgatewayPushes.WithLabelValues("failure").Inc()
+			slog.Error(fmt.Sprintf("Error pushing metrics to the pushgateway: %s", err))
+			continue
+		}
+		pushgatewayPushes.WithLabelValues("success").Inc()
+		slog.Debug("The metrics have been pushed to the pushgateway")
+	}
+}
+
+// Функция удаляет группу экспортера из pushgateway, вызывается при штатной остановке
+func (sink *pushgatewaySink) Delete() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.stopped = true
+	if err := sink.pusher.Delete(); err != nil {
+		slog.Error(fmt.Sprintf("Error deleting the metrics group from the pushgateway: %s", err))
+		return
+	}
+	slog.Info("The metrics group has been deleted from the pushgateway")
+}
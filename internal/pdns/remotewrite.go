@@ -0,0 +1,414 @@
+package pdns
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Настройки отправки метрик по протоколу Prometheus remote write (Mimir, VictoriaMetrics, Prometheus)
+// URL - адрес приема, например https://mimir.dev.test/api/v1/push
+// ExternalLabels - лейблы, добавляемые ко всем рядам (job и instance по умолчанию group-dns-exporter и имя хоста)
+// BatchSize - максимальное количество рядов в одном запросе, QueueSize - количество запросов в очереди в памяти
+// BufferPath - каталог для очереди на диске, если задан, запросы хранятся на диске и переживают перезапуск и простой приемника
+// BufferMaxSize - максимальный размер очереди на диске в мегабайтах, при превышении удаляются самые старые запросы
+type RemoteWriteSettings struct {
+	URL            string            `json:"url" validate:"omitempty,url"`
+	ExternalLabels map[string]string `json:"externalLabels"`
+	BatchSize      int               `json:"batchSize" validate:"gte=0"`
+	QueueSize      int               `json:"queueSize" validate:"gte=0"`
+	BufferPath     string            `json:"bufferPath"`
+	BufferMaxSize  int               `json:"bufferMaxSize" validate:"gte=0"`
+	SinkHttpSettings
+}
+
+// Значения по умолчанию для remote write
+const (
+	defaultRemoteWriteBatchSize  = 2000
+	defaultRemoteWriteQueueSize  = 1000
+	defaultRemoteWriteBufferSize = 256 // мегабайт
+	remoteWriteBackoffStart      = time.Second
+	remoteWriteBackoffMax        = time.Minute
+	remoteWriteFileSuffix        = ".rw"
+	remoteWriteTmpSuffix         = remoteWriteFileSuffix + ".tmp"
+)
+
+// Метрики отправки remote write
+// requests result - success, retry (ошибка, запрос будет повторен) или failure (запрос отклонен и отброшен)
+var (
+	remoteWriteRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "remote_write_requests_total",
+			Help: "Количество запросов remote write по результату",
+		},
+		[]string{"result"},
+	)
+	remoteWriteDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "remote_write_dropped_batches_total",
+			Help: "Количество запросов remote write, удаленных из переполненной очереди",
+		},
+	)
+	remoteWritePending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "remote_write_pending_batches",
+			Help: "Количество запросов remote write в очереди на отправку",
+		},
+	)
+)
+
+// Запрос в очереди: номер и тело (protobuf WriteRequest, сжатый snappy)
+type remoteWriteBatch struct {
+	seq  uint64
+	data []byte
+}
+
+// Очередь запросов remote write, отправляется всегда самый старый запрос, чтобы приемник получал отсчеты по порядку
+// remove удаляет запрос по номеру, если он еще в очереди (мог быть вытеснен при переполнении во время отправки)
+type remoteWriteQueue interface {
+	push(data []byte) error
+	peek() (remoteWriteBatch, bool)
+	remove(seq uint64)
+	size() int
+}
+
+// Очередь в памяти, при переполнении вытесняются самые старые запросы
+type memoryQueue struct {
+	mu      sync.Mutex
+	batches []remoteWriteBatch
+	limit   int
+	seq     uint64
+}
+
+func (queue *memoryQueue) push(data []byte) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.seq++
+	queue.batches = append(queue.batches, remoteWriteBatch{seq: queue.seq, data: data})
+	for len(queue.batches) > queue.limit {
+		queue.dropOldest()
+		remoteWriteDropped.Inc()
+	}
+	return nil
+}
+
+// Функция удаляет самый старый запрос, вызывается под блокировкой
+// слот обнуляется, чтобы тело запроса не оставалось достижимым через массив среза до его перевыделения
+func (queue *memoryQueue) dropOldest() {
+	queue.batches[0] = remoteWriteBatch{}
+	queue.batches = queue.batches[1:]
+}
+
+func (queue *memoryQueue) peek() (remoteWriteBatch, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.batches) == 0 {
+		return remoteWriteBatch{}, false
+	}
+	return queue.batches[0], true
+}
+
+func (queue *memoryQueue) remove(seq uint64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.batches) > 0 && queue.batches[0].seq == seq {
+		queue.dropOldest()
+	}
+}
+
+func (queue *memoryQueue) size() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.batches)
+}
+
+// Очередь на диске, каждый запрос - файл <номер>.rw, номера растут, поэтому порядок сохраняется и после перезапуска
+// при превышении размера вытесняются самые старые файлы
+type diskQueue struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	seqs     []uint64
+	sizes    map[uint64]int64
+	total    int64
+	seq      uint64
+}
+
+// Функция открывает очередь на диске и подхватывает запросы, оставшиеся с прошлого запуска
+// недописанные временные файлы прерванной записи удаляются
+func newDiskQueue(dir string, maxBytes int64) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	queue := &diskQueue{dir: dir, maxBytes: maxBytes, sizes: make(map[uint64]int64)}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), remoteWriteTmpSuffix) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Error(fmt.Sprintf("Error removing the incomplete remote write batch: %s", err))
+			}
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), remoteWriteFileSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), remoteWriteFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		queue.seqs = append(queue.seqs, seq)
+		queue.sizes[seq] = info.Size()
+		queue.total += info.Size()
+		queue.seq = max(queue.seq, seq)
+	}
+	sort.Slice(queue.seqs, func(i, j int) bool { return queue.seqs[i] < queue.seqs[j] })
+	if len(queue.seqs) > 0 {
+		slog.Info(fmt.Sprintf("Found %d remote write batches buffered in %s", len(queue.seqs), dir))
+	}
+	return queue, nil
+}
+
+func (queue *diskQueue) path(seq uint64) string {
+	return filepath.Join(queue.dir, fmt.Sprintf("%020d%s", seq, remoteWriteFileSuffix))
+}
+
+func (queue *diskQueue) push(data []byte) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.seq++
+	// запись через временный файл, чтобы в очередь не попал недописанный запрос
+	tmp := strings.TrimSuffix(queue.path(queue.seq), remoteWriteFileSuffix) + remoteWriteTmpSuffix
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, queue.path(queue.seq)); err != nil {
+		return err
+	}
+	queue.seqs = append(queue.seqs, queue.seq)
+	queue.sizes[queue.seq] = int64(len(data))
+	queue.total += int64(len(data))
+	for queue.total > queue.maxBytes && len(queue.seqs) > 1 {
+		queue.removeLocked(queue.seqs[0])
+		remoteWriteDropped.Inc()
+	}
+	return nil
+}
+
+func (queue *diskQueue) peek() (remoteWriteBatch, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for len(queue.seqs) > 0 {
+		seq := queue.seqs[0]
+		data, err := os.ReadFile(queue.path(seq))
+		if err == nil {
+			return remoteWriteBatch{seq: seq, data: data}, true
+		}
+		slog.Error(fmt.Sprintf("Error reading the buffered remote write batch, it is skipped: %s", err))
+		queue.removeLocked(seq)
+	}
+	return remoteWriteBatch{}, false
+}
+
+func (queue *diskQueue) remove(seq uint64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(queue.seqs) > 0 && queue.seqs[0] == seq {
+		queue.removeLocked(seq)
+	}
+}
+
+// Функция удаляет самый старый запрос, вызывается под блокировкой
+func (queue *diskQueue) removeLocked(seq uint64) {
+	if err := os.Remove(queue.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error(fmt.Sprintf("Error removing the buffered remote write batch: %s", err))
+	}
+	queue.seqs = queue.seqs[1:]
+	queue.total -= queue.sizes[seq]
+	delete(queue.sizes, seq)
+}
+
+func (queue *diskQueue) size() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.seqs)
+}
+
+// Отправитель remote write, после каждого цикла опроса собирает метрики реестра, делит их на запросы и ставит в очередь
+type remoteWriteSink struct {
+	settings       RemoteWriteSettings
+	client         *sinkHttpClient
+	gatherer       prometheus.Gatherer
+	externalLabels []labelPair
+	batchSize      int
+	queue          remoteWriteQueue
+	signal         chan struct{}
+}
+
+// Функция создает отправителя remote write и запускает отправку
+func newRemoteWriteSink(settings RemoteWriteSettings, reg prometheus.Gatherer, reloadInterval time.Duration) (*remoteWriteSink, error) {
+	client, err := newSinkHttpClient("remote_write", settings.SinkHttpSettings, reloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	sink := &remoteWriteSink{
+		settings:  settings,
+		client:    client,
+		gatherer:  reg,
+		batchSize: settings.BatchSize,
+		signal:    make(chan struct{}, 1),
+	}
+	if sink.batchSize == 0 {
+		sink.batchSize = defaultRemoteWriteBatchSize
+	}
+	externalLabels := map[string]string{"job": defaultExporterJob}
+	if hostname, err := os.Hostname(); err == nil {
+		externalLabels["instance"] = hostname
+	}
+	for name, value := range settings.ExternalLabels {
+		externalLabels[name] = value
+	}
+	for name, value := range externalLabels {
+		sink.externalLabels = append(sink.externalLabels, labelPair{Name: name, Value: value})
+	}
+	switch {
+	case settings.BufferPath != "":
+		bufferSize := settings.BufferMaxSize
+		if bufferSize == 0 {
+			bufferSize = defaultRemoteWriteBufferSize
+		}
+		sink.queue, err = newDiskQueue(settings.BufferPath, int64(bufferSize)<<20)
+		if err != nil {
+			return nil, fmt.Errorf("remote write buffer: %w", err)
+		}
+	default:
+		queueSize := settings.QueueSize
+		if queueSize == 0 {
+			queueSize = defaultRemoteWriteQueueSize
+		}
+		sink.queue = &memoryQueue{limit: queueSize}
+	}
+	remoteWritePending.Set(float64(sink.queue.size()))
+	go sink.run()
+	return sink, nil
+}
+
+// Функция ставит в очередь метрики на момент окончания цикла опроса
+func (sink *remoteWriteSink) HandleCycle(snapshot ProbeSnapshot) {
+	samples, err := gatherSamples(sink.gatherer)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error gathering metrics for remote write: %s", err))
+	}
+	timestamp := snapshot.Completed.UnixMilli()
+	for start := 0; start < len(samples); start += sink.batchSize {
+		batch := samples[start:min(start+sink.batchSize, len(samples))]
+		if err := sink.queue.push(snappy.Encode(nil, sink.encode(batch, timestamp))); err != nil {
+			slog.Error(fmt.Sprintf("Error buffering the remote write batch: %s", err))
+		}
+	}
+	remoteWritePending.Set(float64(sink.queue.size()))
+	select {
+	case sink.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Функция кодирует отсчеты в protobuf WriteRequest:
+// WriteRequest{timeseries=1}, TimeSeries{labels=1, samples=2}, Label{name=1, value=2}, Sample{value=1, timestamp=2}
+// внешние лейблы добавляются, если у ряда нет лейбла с таким именем
+func (sink *remoteWriteSink) encode(samples []metricSample, timestamp int64) []byte {
+	var request []byte
+	for _, sample := range samples {
+		labels := appendLabels(sample.Labels, labelPair{Name: "__name__", Value: sample.Name})
+		for _, external := range sink.externalLabels {
+			if !hasLabel(labels, external.Name) {
+				labels = appendLabels(labels, external)
+			}
+		}
+		var series []byte
+		for _, label := range labels {
+			var encoded []byte
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.Name)
+			encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.Value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, encoded)
+		}
+		var point []byte
+		point = protowire.AppendTag(point, 1, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, math.Float64bits(sample.Value))
+		point = protowire.AppendTag(point, 2, protowire.VarintType)
+		point = protowire.AppendVarint(point, uint64(timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, point)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
+
+// Функция проверяет, есть ли у ряда лейбл с заданным именем
+func hasLabel(labels []labelPair, name string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция отправляет запросы из очереди по порядку
+// при ошибке сети, 429 или 5xx запрос повторяется с экспоненциальной паузой, пока приемник не станет доступен,
+// новые запросы в это время копятся в очереди; остальные ошибки означают, что приемник отклонил данные, запрос отбрасывается
+func (sink *remoteWriteSink) run() {
+	backoff := remoteWriteBackoffStart
+	for range sink.signal {
+		for {
+			batch, ok := sink.queue.peek()
+			if !ok {
+				break
+			}
+			err := sink.client.do("POST", sink.settings.URL, "application/x-protobuf", batch.data, map[string]string{
+				"Content-Encoding":                  "snappy",
+				"X-Prometheus-Remote-Write-Version": "0.1.0",
+			})
+			if err != nil && retryableSinkError(err) {
+				remoteWriteRequests.WithLabelValues("retry").Inc()
+				slog.Warn(fmt.Sprintf("Error sending metrics by remote write, retry in %s: %s", backoff, err))
+				time.Sleep(backoff)
+				backoff = min(backoff*2, remoteWriteBackoffMax)
+				continue
+			}
+			backoff = remoteWriteBackoffStart
+			if err != nil {
+				remoteWriteRequests.WithLabelValues("failure").Inc()
+				slog.Error(fmt.Sprintf("The remote write batch has been rejected and dropped: %s", err))
+			} else {
+				remoteWriteRequests.WithLabelValues("success").Inc()
+			}
+			sink.queue.remove(batch.seq)
+			remoteWritePending.Set(float64(sink.queue.size()))
+		}
+	}
+}
+
+// Функция возвращает метрики remote write для регистрации
+func remoteWriteCollectors() []prometheus.Collector {
+	return []prometheus.Collector{remoteWriteRequests, remoteWriteDropped, remoteWritePending}
+}
@@ -0,0 +1,319 @@
+package pdns
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Ряд из разобранного WriteRequest
+type decodedSeries struct {
+	labels    []labelPair
+	value     float64
+	timestamp int64
+}
+
+// Функция разбирает protobuf WriteRequest независимо от кодировщика, проверяя номера и типы полей
+func decodeWriteRequest(t *testing.T, data []byte) []decodedSeries {
+	t.Helper()
+	var result []decodedSeries
+	for _, series := range decodeMessage(t, data, 1) {
+		var decoded decodedSeries
+		for num, fields := range decodeFields(t, series) {
+			for _, field := range fields {
+				switch num {
+				case 1:
+					label := decodeFields(t, field)
+					if len(label[1]) != 1 || len(label[2]) != 1 {
+						t.Fatalf("label must have one name and one value: %v", label)
+					}
+					decoded.labels = append(decoded.labels, labelPair{Name: string(label[1][0]), Value: string(label[2][0])})
+				case 2:
+					decoded.value, decoded.timestamp = decodeSample(t, field)
+				default:
+					t.Fatalf("unexpected TimeSeries field %d", num)
+				}
+			}
+		}
+		result = append(result, decoded)
+	}
+	return result
+}
+
+// Функция возвращает вложенные сообщения поля num, других полей в сообщении быть не должно
+func decodeMessage(t *testing.T, data []byte, num protowire.Number) [][]byte {
+	t.Helper()
+	fields := decodeFields(t, data)
+	for other := range fields {
+		if other != num {
+			t.Fatalf("unexpected field %d", other)
+		}
+	}
+	return fields[num]
+}
+
+// Функция разбирает поля сообщения с типом bytes по номерам, сохраняя порядок
+func decodeFields(t *testing.T, data []byte) map[protowire.Number][][]byte {
+	t.Helper()
+	fields := make(map[protowire.Number][][]byte)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("field %d: want bytes type, got %d (%v)", num, typ, protowire.ParseError(n))
+		}
+		data = data[n:]
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+		fields[num] = append(fields[num], value)
+	}
+	return fields
+}
+
+// Функция разбирает Sample{value=1 double, timestamp=2 int64}
+func decodeSample(t *testing.T, data []byte) (float64, int64) {
+	t.Helper()
+	var value float64
+	var timestamp int64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		data = data[n:]
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			bits, n := protowire.ConsumeFixed64(data)
+			value, data = math.Float64frombits(bits), data[n:]
+		case num == 2 && typ == protowire.VarintType:
+			raw, n := protowire.ConsumeVarint(data)
+			timestamp, data = int64(raw), data[n:]
+		default:
+			t.Fatalf("unexpected Sample field %d type %d", num, typ)
+		}
+	}
+	return value, timestamp
+}
+
+func TestRemoteWriteEncodeGolden(t *testing.T) {
+	sink := &remoteWriteSink{}
+	got := sink.encode([]metricSample{{Name: "up", Labels: []labelPair{{Name: "job", Value: "x"}}, Value: 1}}, 1000)
+	// Label{__name__, up} и Label{job, x}, Sample{1.0, 1000}
+	nameLabel := "\x0a\x08__name__\x12\x02up"
+	jobLabel := "\x0a\x03job\x12\x01x"
+	sample := "\x09\x00\x00\x00\x00\x00\x00\xf0\x3f\x10\xe8\x07"
+	series := "\x0a\x0e" + nameLabel + "\x0a\x08" + jobLabel + "\x12\x0c" + sample
+	want := []byte("\x0a\x28" + series)
+	if !bytes.Equal(got, want) {
+		t.Errorf("encode:\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestRemoteWriteEncodeLabels(t *testing.T) {
+	sink := &remoteWriteSink{externalLabels: []labelPair{{Name: "job", Value: "exporter"}, {Name: "dc", Value: "msk"}, {Name: "zone", Value: "a"}}}
+	samples := []metricSample{
+		{Name: "available_auth_node", Labels: []labelPair{{Name: "cluster", Value: "g1"}, {Name: "role", Value: "master"}}, Value: 1},
+		{Name: "response_time_seconds_bucket", Labels: []labelPair{{Name: "job", Value: "own"}, {Name: "le", Value: "+Inf"}}, Value: 3},
+		{Name: "exporter_up", Value: math.NaN()},
+	}
+	series := decodeWriteRequest(t, sink.encode(samples, 1700000000123))
+	if len(series) != len(samples) {
+		t.Fatalf("series = %d, want %d", len(series), len(samples))
+	}
+	for i, decoded := range series {
+		if !sort.SliceIsSorted(decoded.labels, func(a, b int) bool { return decoded.labels[a].Name < decoded.labels[b].Name }) {
+			t.Errorf("series %d: labels are not sorted: %v", i, decoded.labels)
+		}
+		names := make(map[string]string)
+		for _, label := range decoded.labels {
+			if _, dup := names[label.Name]; dup {
+				t.Errorf("series %d: duplicate label %s", i, label.Name)
+			}
+			names[label.Name] = label.Value
+		}
+		if names["__name__"] != samples[i].Name {
+			t.Errorf("series %d: __name__ = %q, want %q", i, names["__name__"], samples[i].Name)
+		}
+		if names["dc"] != "msk" || names["zone"] != "a" {
+			t.Errorf("series %d: external labels are missing: %v", i, decoded.labels)
+		}
+		if decoded.timestamp != 1700000000123 {
+			t.Errorf("series %d: timestamp = %d", i, decoded.timestamp)
+		}
+	}
+	// лейбл ряда не перекрывается внешним
+	if findLabel(series[1].labels, "job") != "own" {
+		t.Errorf("the series job label must be kept: %v", series[1].labels)
+	}
+	if findLabel(series[0].labels, "job") != "exporter" {
+		t.Errorf("the external job label must be added: %v", series[0].labels)
+	}
+	if series[1].value != 3 || !math.IsNaN(series[2].value) {
+		t.Errorf("values = %v, %v, want 3 and NaN", series[1].value, series[2].value)
+	}
+}
+
+func findLabel(labels []labelPair, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+func TestRemoteWriteHandleCycleBatches(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"}, []string{"node"})
+	reg.MustRegister(gauge)
+	for _, node := range []string{"a", "b", "c"} {
+		gauge.WithLabelValues(node).Set(1)
+	}
+	sink := &remoteWriteSink{gatherer: reg, batchSize: 2, queue: &memoryQueue{limit: 10}, signal: make(chan struct{}, 1)}
+	sink.HandleCycle(ProbeSnapshot{Completed: time.UnixMilli(5000)})
+
+	var nodes []string
+	for sink.queue.size() > 0 {
+		batch, _ := sink.queue.peek()
+		data, err := snappy.Decode(nil, batch.data)
+		if err != nil {
+			t.Fatalf("snappy: %s", err)
+		}
+		series := decodeWriteRequest(t, data)
+		if len(series) > 2 {
+			t.Errorf("batch of %d series, want at most 2", len(series))
+		}
+		for _, decoded := range series {
+			nodes = append(nodes, findLabel(decoded.labels, "node"))
+			if decoded.timestamp != 5000 {
+				t.Errorf("timestamp = %d, want the cycle completion time", decoded.timestamp)
+			}
+		}
+		sink.queue.remove(batch.seq)
+	}
+	if len(nodes) != 3 || nodes[0] != "a" || nodes[1] != "b" || nodes[2] != "c" {
+		t.Errorf("nodes = %v, want [a b c]", nodes)
+	}
+}
+
+// Функция забирает из очереди все запросы по порядку
+func drainQueue(t *testing.T, queue remoteWriteQueue) []string {
+	t.Helper()
+	var batches []string
+	for {
+		batch, ok := queue.peek()
+		if !ok {
+			return batches
+		}
+		batches = append(batches, string(batch.data))
+		queue.remove(batch.seq)
+	}
+}
+
+func TestDiskQueueOrderAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := newDiskQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"one", "two", "three"} {
+		if err := queue.push([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch, _ := queue.peek()
+	queue.remove(batch.seq)
+
+	// недописанный запрос при открытии удаляется, посторонние файлы пропускаются
+	tmp := filepath.Join(dir, "00000000000000000009"+remoteWriteTmpSuffix)
+	os.WriteFile(tmp, []byte("partial"), 0o600)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0o600)
+
+	reopened, err := newDiskQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.size() != 2 {
+		t.Fatalf("size after reopen = %d, want 2", reopened.size())
+	}
+	if _, err := os.Stat(tmp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the incomplete batch %s must be removed on open, stat error = %v", tmp, err)
+	}
+	if err := reopened.push([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	got := drainQueue(t, reopened)
+	want := []string{"two", "three", "four"}
+	if len(got) != len(want) {
+		t.Fatalf("batches = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("batches = %v, want %v", got, want)
+			break
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+remoteWriteFileSuffix))
+	if len(files) != 0 {
+		t.Errorf("sent batches must be removed from disk, left %v", files)
+	}
+}
+
+func TestMemoryQueueReleasesEvictedBatches(t *testing.T) {
+	queue := &memoryQueue{limit: 2, batches: make([]remoteWriteBatch, 0, 8)}
+	backing := queue.batches[:cap(queue.batches)]
+	for _, data := range []string{"one", "two", "three"} {
+		queue.push([]byte(data))
+	}
+	batch, _ := queue.peek()
+	queue.remove(batch.seq)
+	if queue.size() != 1 {
+		t.Fatalf("size = %d, want 1", queue.size())
+	}
+	// тела вытесненного и отправленного запросов не остаются в массиве среза
+	for _, old := range backing {
+		if string(old.data) == "one" || string(old.data) == "two" {
+			t.Errorf("the batch %q is still referenced by the queue", old.data)
+		}
+	}
+}
+
+func TestDiskQueueEvictsOldest(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := newDiskQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := queue.push([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queue.size() != 2 || queue.total != 8 {
+		t.Errorf("size = %d, total = %d, want 2 batches of 8 bytes", queue.size(), queue.total)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+remoteWriteFileSuffix))
+	if len(files) != 2 {
+		t.Errorf("files on disk = %d, want 2", len(files))
+	}
+
+	// запрос больше лимита остается в очереди один
+	if err := queue.push([]byte("dddddddddddd")); err != nil {
+		t.Fatal(err)
+	}
+	got := drainQueue(t, queue)
+	if len(got) != 1 || got[0] != "dddddddddddd" {
+		t.Errorf("batches = %v, want only the newest", got)
+	}
+	if queue.total != 0 {
+		t.Errorf("total after drain = %d, want 0", queue.total)
+	}
+}
@@ -1,194 +1,368 @@
-package pdns
-
-import (
-	"fmt"
-	"log/slog"
-	"net"
-	"net/http"
-
-	"crypto/tls"
-	"crypto/x509"
-
-	"os"
-
-	"sync"
-	"time"
-
-	"github.com/miekg/dns"
-)
-
-// Структура, где поля будут содержать результаты запроса
-type DnsResponseData struct {
-	ServerID       string
-	TimeToResponse time.Duration
-	Msg            *dns.Msg
-	Availability   bool
-}
-
-// Структура, необходимая для днс запроса
-type DnsRequestData struct {
-	ServerID string
-	Address  string
-	Fqdn     string
-	Port     int32
-}
-
-// Структура http ответа, можно расширить и собрать побольше данных из ответа
-type HttpResponseData struct {
-	ServerID     string
-	ResponseCode int16
-	Availability bool
-}
-
-// структура, необходимая для создания http запроса, формирования строки запроса и записи хедеров
-type HttpRequestData struct {
-	ServerID string
-	Address  string
-	ApiToken string
-	Port     int32
-	Tls      bool
-}
-
-// Функия для создание структуры с данными для запроса dns
-func CreateDnsRequestData(clusterID, address, record string, dnsPort int32) DnsRequestData {
-	return DnsRequestData{
-		ServerID: clusterID,
-		Address:  address,
-		Fqdn:     record,
-		Port:     dnsPort,
-	}
-}
-
-// Функия для создание структуры с данными для запроса http/https
-func CreateHttpRequestData(clusterID, address, apiToken string, port int32, tls bool) HttpRequestData {
-	return HttpRequestData{
-		ServerID: clusterID,
-		Address:  address,
-		Port:     port,
-		ApiToken: apiToken,
-		Tls:      tls,
-	}
-}
-
-// Функция для создания http клиента (http/https)
-func CreateHttpClient(tlsCheck bool, certPath, keyPath string) *http.Client {
-	var httpClient *http.Client
-	if !tlsCheck {
-		httpClient = &http.Client{}
-	} else {
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			//log.Fatal(err.Error())
-			slog.Error(err.Error())
-		}
-		// Create a CA certificate pool and add cert.pem to it
-		caCert, err := os.ReadFile(certPath)
-		if err != nil {
-			slog.Error(err.Error())
-		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		// Create a HTTPS client and supply the created CA pool and certificate
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs:      caCertPool,
-					Certificates: []tls.Certificate{cert},
-				},
-			},
-		}
-	}
-	return httpClient
-}
-
-// Функция для создание днс клиента
-func CreateDnsClient() *dns.Client {
-	var dnsClient dns.Client
-	dnsClient.Dialer = &net.Dialer{ // устанавливаем маскимальное время ожидания ответа (300 миллисекунд)
-		Timeout: 300 * time.Millisecond,
-	}
-	return &dnsClient
-}
-
-// Функция для создание http запроса
-func createHttpRequest(hrd HttpRequestData) (*http.Request, error) {
-	var protocol string
-	if !hrd.Tls {
-		protocol = "http"
-	} else {
-		protocol = "https"
-	}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s:%d/api/v1/servers", protocol, hrd.Address, hrd.Port), nil)
-	if err != nil {
-		return nil, err
-	} else {
-		req.Header.Set("X-API-Key", hrd.ApiToken)
-		return req, nil
-	}
-}
-
-// Функция по выполнению днс запросов
-func DnsRequest(drd DnsRequestData, chDns chan DnsResponseData, dnsClient *dns.Client, Wg *sync.WaitGroup) {
-	defer Wg.Done()
-	var (
-		msg        dns.Msg
-		data       DnsResponseData
-		checkAvail bool
-	)
-	data.ServerID = drd.ServerID
-	fqdn := dns.Fqdn(drd.Fqdn)
-	msg.SetQuestion(fqdn, dns.TypeA)
-	resp, ttr, err := dnsClient.Exchange(&msg, fmt.Sprintf("%s:%d", drd.Address, drd.Port)) // выполнение запроса
-	if err != nil {
-		checkAvail = false
-	} else {
-		checkAvail = true
-	}
-	// время ответа возвращается в миллисекундах, 300 - порог
-	responseDns := DnsResponseData{
-		ServerID:       drd.ServerID,
-		Availability:   checkAvail,
-		TimeToResponse: time.Duration(ttr.Milliseconds()),
-		Msg:            resp,
-	}
-	chDns <- responseDns
-}
-
-// Функция выполнения http запроса
-func HttpRequest(hrd HttpRequestData, chHttp chan HttpResponseData, httpClient *http.Client, Wg *sync.WaitGroup) {
-	defer Wg.Done()
-	var checkAvail bool
-	var respCode int16
-	requestBalancer, errCreateHtR := createHttpRequest(hrd)
-	if errCreateHtR != nil { // если ошибка создания запроса, логируем, возвращаем ошибку и структуру, не ронять процесс из-за одного итема
-		slog.Error(fmt.Sprintf("Error create http request. f.HttpRequest.s154, target request: %s", hrd.Address))
-		responseHttp := HttpResponseData{
-			ServerID:     hrd.ServerID,
-			ResponseCode: 400, // bad request
-			Availability: false,
-		}
-		chHttp <- responseHttp
-		return
-	}
-	resp, err := httpClient.Do(requestBalancer)
-
-	if err != nil { // если есть ошибка (сеть, недоступен порт и тд), поставим код 503, пока нигде он не отражается
-		checkAvail = false
-		respCode = 503
-	} else if resp.StatusCode != 200 { // проверка на код 200
-		checkAvail = false
-		respCode = int16(resp.StatusCode)
-		defer resp.Body.Close()
-	} else { // если сетевой ошибки нет, код ответа 200, то общая доступность true и добавим код ответа в структуру
-		checkAvail = true
-		respCode = int16(resp.StatusCode)
-		defer resp.Body.Close()
-	}
-
-	responseHttp := HttpResponseData{ // возвращаем структуру, ее можно расширить для доп метрик, пока - код ответа и общая доступность
-		ServerID:     hrd.ServerID,
-		ResponseCode: respCode,
-		Availability: checkAvail,
-	}
-	chHttp <- responseHttp
-}
+package pdns
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"crypto/tls"
+
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Структура, где поля будут содержать результаты запроса
+// TimeToResponse - среднее время ответа по серии, Samples - время каждого полученного ответа
+// FailureReason и FailureDetail заполняются, если сервер признан недоступным
+type DnsResponseData struct {
+	ServerID       string
+	Address        string
+	Family         string
+	TimeToResponse time.Duration
+	Msg            *dns.Msg
+	Availability   bool
+	Samples        []time.Duration
+	FailureReason  FailureReason
+	FailureDetail  string
+	PeerCert       *PeerCert     // сертификат сервера для DoT и DoH, последний полученный за серию
+	Started        time.Time     // время начала серии запросов
+	Duration       time.Duration // длительность серии запросов
+	SampleStats
+}
+
+// Статистика серии dns запросов к одному серверу
+type SampleStats struct {
+	Sent       int
+	Received   int
+	PacketLoss float64 // доля потерянных запросов от 0 до 1
+	MinTTR     time.Duration
+	AvgTTR     time.Duration
+	MaxTTR     time.Duration
+	Jitter     time.Duration // среднее отклонение времени ответа между соседними запросами
+}
+
+// Структура, необходимая для днс запроса
+// Address - ip адрес сервера, Family - его семейство для лейбла метрик, Host - адрес из конфига (имя для tls)
+// Protocol - udp (по умолчанию), tcp, tls или https, DohPath - путь запроса DoH
+type DnsRequestData struct {
+	ServerID       string
+	Address        string
+	Family         string
+	Host           string
+	Fqdn           string
+	Port           int32
+	ExpectedAnswer string
+	Sampling       ProbeSampling
+	Protocol       string
+	DohPath        string
+	Kind           string // тип проверки для метрик экспортера: auth_dns или recursor_dns
+}
+
+// Структура http ответа, можно расширить и собрать побольше данных из ответа
+// ResponseCode равен 0, если ответ не получен, причина - в FailureReason
+type HttpResponseData struct {
+	ServerID      string
+	Address       string
+	Family        string
+	ResponseCode  int16
+	Availability  bool
+	FailureReason FailureReason
+	FailureDetail string
+	PeerCert      *PeerCert     // сертификат сервера апи, если запрос выполнялся по https
+	Started       time.Time     // время отправки запроса
+	Duration      time.Duration // длительность запроса
+}
+
+// структура, необходимая для создания http запроса, формирования строки запроса и записи хедеров
+// Address.Host идет в url, подключение выполняется к Address.IP
+type HttpRequestData struct {
+	ServerID string
+	Address  ProbeAddress
+	ApiToken string
+	Port     int32
+	Tls      bool
+}
+
+// Функия для создание структуры с данными для запроса dns
+func CreateDnsRequestData(clusterID string, address ProbeAddress, record, expectedAnswer string, dnsPort int32, sampling ProbeSampling) DnsRequestData {
+	return DnsRequestData{
+		ServerID:       clusterID,
+		Address:        address.IP,
+		Family:         address.Family,
+		Host:           address.Host,
+		Fqdn:           record,
+		Port:           dnsPort,
+		ExpectedAnswer: expectedAnswer,
+		Sampling:       sampling,
+	}
+}
+
+// Функия для создание структуры с данными для запроса http/https
+func CreateHttpRequestData(clusterID string, address ProbeAddress, apiToken string, port int32, tls bool) HttpRequestData {
+	return HttpRequestData{
+		ServerID: clusterID,
+		Address:  address,
+		Port:     port,
+		ApiToken: apiToken,
+		Tls:      tls,
+	}
+}
+
+// Функция для создания http клиента (http/https)
+// сертификаты берутся из CertReloader при каждом tls рукопожатии, nil - клиент без tls
+// serverName - имя для SNI и проверки сертификата сервера, если пусто - берется адрес из url
+func CreateHttpClient(certs *CertReloader, serverName string) *http.Client {
+	var httpClient *http.Client
+	// транспорт подключается к разрешенному адресу ноды, см. dialProbeAddress
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialProbeAddress(&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	})
+	// соединения не переиспользуются: для dual-stack ноды запросы к разным семействам идут на один host:port
+	transport.DisableKeepAlives = true
+	if certs == nil {
+		httpClient = &http.Client{Transport: transport}
+	} else {
+		// пул ca берется на момент создания клиента (клиент создается на каждый цикл опроса),
+		// клиентский сертификат - на каждое рукопожатие
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:              certs.CAPool(),
+			GetClientCertificate: certs.GetClientCertificate,
+			ServerName:           serverName,
+		}
+		httpClient = &http.Client{Transport: transport}
+	}
+	return httpClient
+}
+
+// максимальное время ожидания ответа на один dns запрос
+const dnsQueryTimeout = 300 * time.Millisecond
+
+// Функция для создание днс клиента
+func CreateDnsClient() *dns.Client {
+	var dnsClient dns.Client
+	dnsClient.Dialer = &net.Dialer{ // устанавливаем маскимальное время ожидания ответа
+		Timeout: dnsQueryTimeout,
+	}
+	return &dnsClient
+}
+
+// Функция для создание http запроса, ctx ограничивает время запроса
+func createHttpRequest(ctx context.Context, hrd HttpRequestData) (*http.Request, error) {
+	var protocol string
+	if !hrd.Tls {
+		protocol = "http"
+	} else {
+		protocol = "https"
+	}
+	// JoinHostPort берет ipv6 адрес в квадратные скобки
+	hostPort := net.JoinHostPort(hrd.Address.Host, strconv.Itoa(int(hrd.Port)))
+	ctx = context.WithValue(ctx, dialAddressKey{}, hrd.Address)
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s://%s/api/v1/servers", protocol, hostPort), nil)
+	if err != nil {
+		return nil, err
+	} else {
+		req.Header.Set("X-API-Key", hrd.ApiToken)
+		return req, nil
+	}
+}
+
+// Функция по выполнению днс запросов, за цикл отправляется серия из Sampling.Samples запросов
+func DnsRequest(drd DnsRequestData, chDns chan DnsResponseData, dnsClient *dns.Client, Wg *sync.WaitGroup) {
+	defer Wg.Done()
+	started := time.Now()
+	probeDone := startProbe(drd.Kind)
+	var (
+		msg      dns.Msg
+		lastMsg  *dns.Msg
+		lastErr  error
+		samples  []time.Duration
+		peerCert *PeerCert
+	)
+	fqdn := dns.Fqdn(drd.Fqdn)
+	msg.SetQuestion(fqdn, dns.TypeA)
+	count := drd.Sampling.count()
+	exchange := newDnsExchange(drd, dnsClient)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(drd.Sampling.interval())
+		}
+		msg.Id = dns.Id()                      // у каждого запроса серии свой id, чтобы опоздавший ответ не засчитался следующему
+		resp, ttr, cert, err := exchange(&msg) // выполнение запроса
+		if cert != nil {
+			peerCert = cert
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		samples = append(samples, ttr)
+		lastMsg = resp
+	}
+	stats := calcSampleStats(count, samples)
+	// сервер доступен, если получен хотя бы один ответ, потери не выше порога и последний ответ корректен
+	responseDns := DnsResponseData{
+		ServerID:       drd.ServerID,
+		Address:        drd.Address,
+		Family:         drd.Family,
+		TimeToResponse: stats.AvgTTR,
+		Msg:            lastMsg,
+		Samples:        samples,
+		PeerCert:       peerCert,
+		Started:        started,
+		Duration:       time.Since(started),
+		SampleStats:    stats,
+	}
+	switch {
+	case stats.Received == 0:
+		responseDns.FailureReason = classifyError(lastErr)
+		responseDns.FailureDetail = lastErr.Error()
+	case stats.PacketLoss > drd.Sampling.threshold():
+		responseDns.FailureReason = ReasonPacketLoss
+		responseDns.FailureDetail = fmt.Sprintf("packet loss %.2f, last error: %s", stats.PacketLoss, lastErr)
+	default:
+		responseDns.FailureReason, responseDns.FailureDetail = checkDnsAnswer(lastMsg, fqdn, drd.ExpectedAnswer)
+	}
+	responseDns.Availability = responseDns.FailureReason == ReasonNone
+	probeDone(responseDns.Availability)
+	chDns <- responseDns
+}
+
+// rcode, который записывается в результат, если сервер не ответил (условно - рефьюз)
+const rcodeNoResponse = int8(111)
+
+// Функция возвращает rcode ответа или rcodeNoResponse, если ответ не получен
+func responseRcode(msg *dns.Msg) int8 {
+	if msg == nil {
+		return rcodeNoResponse
+	}
+	return int8(msg.Rcode)
+}
+
+// Функция проверяет rcode ответа и, если задан ожидаемый адрес, наличие его в ответе
+// адрес ищется в A записях запрошенного имени и имен, на которые оно ссылается через CNAME в ответе, регистр имен не учитывается
+func checkDnsAnswer(resp *dns.Msg, fqdn, expectedAnswer string) (FailureReason, string) {
+	if resp.Rcode != dns.RcodeSuccess {
+		return ReasonBadRcode, fmt.Sprintf("rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	if expectedAnswer == "" {
+		return ReasonNone, ""
+	}
+	names := map[string]bool{dns.CanonicalName(fqdn): true}
+	for range resp.Answer { // цепочка CNAME не длиннее ответа, записи могут идти в любом порядке
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && names[dns.CanonicalName(cname.Hdr.Name)] {
+				names[dns.CanonicalName(cname.Target)] = true
+			}
+		}
+	}
+	expectedIP := net.ParseIP(expectedAnswer)
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok && names[dns.CanonicalName(a.Hdr.Name)] && a.A.Equal(expectedIP) {
+			return ReasonNone, ""
+		}
+	}
+	return ReasonAnswerMismatch, fmt.Sprintf("%s not found in the answer for %s", expectedAnswer, fqdn)
+}
+
+// Функция считает потери, min/avg/max время ответа и джиттер по серии запросов
+func calcSampleStats(sent int, samples []time.Duration) SampleStats {
+	stats := SampleStats{
+		Sent:     sent,
+		Received: len(samples),
+	}
+	if sent > 0 {
+		stats.PacketLoss = float64(sent-len(samples)) / float64(sent)
+	}
+	if len(samples) == 0 {
+		return stats
+	}
+	var sum, diffSum time.Duration
+	stats.MinTTR = samples[0]
+	stats.MaxTTR = samples[0]
+	for i, sample := range samples {
+		sum += sample
+		stats.MinTTR = min(stats.MinTTR, sample)
+		stats.MaxTTR = max(stats.MaxTTR, sample)
+		if i > 0 {
+			diff := sample - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			diffSum += diff
+		}
+	}
+	stats.AvgTTR = sum / time.Duration(len(samples))
+	if len(samples) > 1 {
+		stats.Jitter = diffSum / time.Duration(len(samples)-1)
+	}
+	return stats
+}
+
+// Функция выполнения http запроса
+func HttpRequest(ctx context.Context, hrd HttpRequestData, chHttp chan HttpResponseData, httpClient *http.Client, Wg *sync.WaitGroup) {
+	defer Wg.Done()
+	started := time.Now()
+	probeDone := startProbe(probeKindAuthHttp)
+	var checkAvail bool
+	var respCode int16
+	var reason FailureReason
+	var detail string
+	requestBalancer, errCreateHtR := createHttpRequest(ctx, hrd)
+	if errCreateHtR != nil { // если ошибка создания запроса, логируем, возвращаем ошибку и структуру, не ронять процесс из-за одного итема
+		slog.Error(fmt.Sprintf("Error create http request. f.HttpRequest, target request: %s", hrd.Address.Host))
+		responseHttp := HttpResponseData{
+			ServerID:      hrd.ServerID,
+			Address:       hrd.Address.IP,
+			Family:        hrd.Address.Family,
+			Availability:  false,
+			FailureReason: ReasonRequestError,
+			FailureDetail: errCreateHtR.Error(),
+			Started:       started,
+			Duration:      time.Since(started),
+		}
+		probeDone(false)
+		chHttp <- responseHttp
+		return
+	}
+	resp, err := httpClient.Do(requestBalancer)
+
+	if err != nil { // если есть ошибка (сеть, недоступен порт, tls и тд), ответа нет - код 0, причина определяется по ошибке
+		checkAvail = false
+		reason = classifyError(err)
+		detail = err.Error()
+	} else if resp.StatusCode != 200 { // проверка на код 200
+		checkAvail = false
+		respCode = int16(resp.StatusCode)
+		reason = classifyHttpCode(resp.StatusCode)
+		detail = resp.Status
+		defer resp.Body.Close()
+	} else { // если сетевой ошибки нет, код ответа 200, то общая доступность true и добавим код ответа в структуру
+		checkAvail = true
+		respCode = int16(resp.StatusCode)
+		defer resp.Body.Close()
+	}
+
+	responseHttp := HttpResponseData{ // возвращаем структуру, ее можно расширить для доп метрик, пока - код ответа, общая доступность и причина отказа
+		ServerID:      hrd.ServerID,
+		Address:       hrd.Address.IP,
+		Family:        hrd.Address.Family,
+		ResponseCode:  respCode,
+		Availability:  checkAvail,
+		FailureReason: reason,
+		FailureDetail: detail,
+		Started:       started,
+		Duration:      time.Since(started),
+	}
+	if resp != nil {
+		responseHttp.PeerCert = newPeerCert(resp.TLS)
+	}
+	probeDone(checkAvail)
+	chHttp <- responseHttp
+}
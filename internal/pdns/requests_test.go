@@ -0,0 +1,92 @@
+package pdns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHttpRequestHangingBalancer(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	hrd := CreateHttpRequestData("cluster", ProbeAddress{Host: host, IP: host, Family: labelIPv4}, "token", int32(portNumber), false)
+	chHttp := make(chan HttpResponseData, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	started := time.Now()
+	go HttpRequest(ctx, hrd, chHttp, CreateHttpClient(nil, ""), &wg)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request to a balancer that never answers is not interrupted")
+	}
+	resp := <-chHttp
+	if resp.Availability || resp.FailureReason != ReasonReadTimeout {
+		t.Errorf("availability = %v, reason = %s, want an unavailable node with %s", resp.Availability, resp.FailureReason, ReasonReadTimeout)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("the request took %s, want about the probe timeout", elapsed)
+	}
+}
+
+func TestCheckDnsAnswer(t *testing.T) {
+	rr := func(text string) dns.RR {
+		record, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	cases := []struct {
+		name   string
+		answer []dns.RR
+		want   FailureReason
+	}{
+		{"exact owner", []dns.RR{rr("example.com. 60 IN A 192.0.2.1")}, ReasonNone},
+		{"owner in another case", []dns.RR{rr("Example.COM. 60 IN A 192.0.2.1")}, ReasonNone},
+		{"through cname", []dns.RR{rr("example.com. 60 IN CNAME edge.example.net."), rr("edge.example.net. 60 IN A 192.0.2.1")}, ReasonNone},
+		{"through a cname chain out of order", []dns.RR{
+			rr("b.example.net. 60 IN A 192.0.2.1"),
+			rr("a.example.net. 60 IN CNAME B.example.net."),
+			rr("EXAMPLE.com. 60 IN CNAME a.example.net."),
+		}, ReasonNone},
+		{"other address", []dns.RR{rr("example.com. 60 IN A 192.0.2.2")}, ReasonAnswerMismatch},
+		{"address of an unrelated name", []dns.RR{rr("other.example.com. 60 IN A 192.0.2.1")}, ReasonAnswerMismatch},
+		{"cname of an unrelated name", []dns.RR{rr("other.example.com. 60 IN CNAME edge.example.net."), rr("edge.example.net. 60 IN A 192.0.2.1")}, ReasonAnswerMismatch},
+		{"empty answer", nil, ReasonAnswerMismatch},
+	}
+	for _, tc := range cases {
+		msg := new(dns.Msg)
+		msg.Answer = tc.answer
+		if got, _ := checkDnsAnswer(msg, "example.com.", "192.0.2.1"); got != tc.want {
+			t.Errorf("%s: reason = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	msg := new(dns.Msg)
+	msg.Rcode = dns.RcodeNameError
+	if got, _ := checkDnsAnswer(msg, "example.com.", ""); got != ReasonBadRcode {
+		t.Errorf("nxdomain: reason = %q, want %q", got, ReasonBadRcode)
+	}
+}
@@ -0,0 +1,119 @@
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Файлы сертификата, ключа и бандла ca для запросов к апи, по ним переиспользуются CertReloader
+type requestsCertFiles struct {
+	cert string
+	key  string
+	ca   string
+}
+
+// сертификаты для запросов к апи серверов авторити по файлам, пусто - если mtlsRequests выключен
+var requestsCerts map[requestsCertFiles]*CertReloader
+
+// группы по source метрик сертификатов групп и кластеров, по ним метрики сертификатов фильтруются по командам
+var requestsCertGroups map[string]string
+
+// префикс source метрик сертификатов, переопределенных для группы или кластера
+const requestsGroupSourcePrefix = "requests/"
+
+// Функция дополняет настройки кластера настройками группы
+func (clusterTls RequestsTls) merge(groupTls RequestsTls) RequestsTls {
+	if clusterTls.TlsServerName == "" {
+		clusterTls.TlsServerName = groupTls.TlsServerName
+	}
+	if clusterTls.TlsCA == "" {
+		clusterTls.TlsCA = groupTls.TlsCA
+	}
+	if clusterTls.TlsCert == "" {
+		clusterTls.TlsCert, clusterTls.TlsKey = groupTls.TlsCert, groupTls.TlsKey
+	}
+	return clusterTls
+}
+
+// Функция возвращает файлы для запросов к апи: переопределенные для кластера или из mtlsRequests
+func (clusterTls RequestsTls) files(tlsSet MtlsRequests) requestsCertFiles {
+	files := requestsCertFiles{cert: tlsSet.Cert, key: tlsSet.Key, ca: requestsCA(tlsSet)}
+	if clusterTls.TlsCert != "" {
+		files.cert, files.key = clusterTls.TlsCert, clusterTls.TlsKey
+	}
+	if clusterTls.TlsCA != "" {
+		files.ca = clusterTls.TlsCA
+	}
+	return files
+}
+
+// Функция возвращает бандл ca из mtlsRequests
+func requestsCA(tlsSet MtlsRequests) string {
+	// для совместимости со старыми конфигами без ca пул собирается из клиентского сертификата
+	if tlsSet.CA == "" {
+		return tlsSet.Cert
+	}
+	return tlsSet.CA
+}
+
+// Функция загружает сертификаты для запросов к апи: общие из mtlsRequests и переопределенные для групп и кластеров
+// одинаковые наборы файлов загружаются один раз, source метрик - requests или requests/<группа>[/<кластер>]
+func initRequestsCerts(conf *Conf, interval time.Duration) error {
+	requestsCerts = make(map[requestsCertFiles]*CertReloader)
+	requestsCertGroups = make(map[string]string)
+	if !conf.MtlsRequest.Enabled {
+		return nil
+	}
+	if conf.MtlsRequest.CA == "" {
+		slog.Warn("ca is not set in mtlsRequests, the client certificate is used to verify the api servers")
+	}
+	load := func(source string, files requestsCertFiles) error {
+		if _, ok := requestsCerts[files]; ok {
+			return nil
+		}
+		certs, err := NewCertReloader(source, files.cert, files.key, files.ca)
+		if err != nil {
+			return err
+		}
+		requestsCerts[files] = certs
+		go certs.Watch(interval)
+		return nil
+	}
+	if err := load("requests", RequestsTls{}.files(conf.MtlsRequest)); err != nil {
+		return err
+	}
+	for _, megacluster := range conf.AuthClusters {
+		for _, simplecluster := range megacluster.SimpleClusters {
+			clusterTls := simplecluster.RequestsTls.merge(megacluster.RequestsTls)
+			source := requestsGroupSourcePrefix + megacluster.MegaClusterID
+			if simplecluster.TlsCert != "" || simplecluster.TlsCA != "" {
+				source = fmt.Sprintf("%s%s/%s", requestsGroupSourcePrefix, megacluster.MegaClusterID, simplecluster.ClusterID)
+			}
+			requestsCertGroups[source] = megacluster.MegaClusterID
+			if err := load(source, clusterTls.files(conf.MtlsRequest)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Функция возвращает сертификаты и имя сервера для запросов к апи кластера, nil - запросы без tls
+func requestsTlsFor(tlsSet MtlsRequests, megacluster AuthCluster, simplecluster SimpleCluster) (*CertReloader, string) {
+	if !tlsSet.Enabled {
+		return nil, ""
+	}
+	clusterTls := simplecluster.RequestsTls.merge(megacluster.RequestsTls)
+	return requestsCerts[clusterTls.files(tlsSet)], clusterTls.TlsServerName
+}
+
+// Функция возвращает группу по source метрик сертификатов, ok - source относится к группе или кластеру
+// для неизвестного source группы возвращается пустая группа, чтобы метрика не попала командам без "*"
+func requestsSourceGroup(source string) (group string, ok bool) {
+	if !strings.HasPrefix(source, requestsGroupSourcePrefix) {
+		return "", false
+	}
+	return requestsCertGroups[source], true
+}
@@ -0,0 +1,105 @@
+package pdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Семейства адресов для опроса, значения поля addressFamily в конфиге
+const (
+	familyAny  = "any"  // первый адрес из ответа резолвера, любого семейства
+	familyIPv4 = "ip4"  // только ipv4
+	familyIPv6 = "ip6"  // только ipv6
+	familyBoth = "both" // по одному адресу каждого семейства, для dual-stack нод
+)
+
+// Значения лейбла family в метриках
+const (
+	labelIPv4    = "ipv4"
+	labelIPv6    = "ipv6"
+	labelUnknown = "unknown" // имя не удалось разрешить
+)
+
+// время ожидания ответа резолвера при разрешении имени ноды
+const resolveTimeout = 2 * time.Second
+
+// Адрес цели опроса после разрешения имени
+// Host - адрес из конфига (ip или имя), используется в url и для проверки сертификата
+// IP - адрес, к которому выполняется подключение, Family - семейство для лейбла метрик
+type ProbeAddress struct {
+	Host   string
+	IP     string
+	Family string
+}
+
+// Функция возвращает семейство ip адреса для лейбла метрик
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return labelIPv4
+	}
+	return labelIPv6
+}
+
+// Функция разрешает адрес из конфига (ipv4, ipv6 или имя) в список адресов для опроса с учетом семейства
+func resolveProbeAddresses(address, family string) ([]ProbeAddress, error) {
+	if ip := net.ParseIP(address); ip != nil { // ip адрес опрашивается как есть, семейство определяется по нему
+		return []ProbeAddress{{Host: address, IP: ip.String(), Family: ipFamily(ip)}}, nil
+	}
+	network := "ip"
+	switch family {
+	case familyIPv4:
+		network = "ip4"
+	case familyIPv6:
+		network = "ip6"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: address, IsNotFound: true}
+	}
+	if family != familyBoth {
+		return []ProbeAddress{{Host: address, IP: ips[0].String(), Family: ipFamily(ips[0])}}, nil
+	}
+	var addresses []ProbeAddress
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		if seen[ipFamily(ip)] {
+			continue
+		}
+		seen[ipFamily(ip)] = true
+		addresses = append(addresses, ProbeAddress{Host: address, IP: ip.String(), Family: ipFamily(ip)})
+	}
+	return addresses, nil
+}
+
+// Адрес-заглушка для цели, имя которой не удалось разрешить
+func unresolvedAddress(address string) ProbeAddress {
+	return ProbeAddress{Host: address, Family: labelUnknown}
+}
+
+// ключ контекста http запроса с адресом, к которому должен подключиться транспорт
+type dialAddressKey struct{}
+
+// Функция подключения для http транспорта: вместо имени из url подключается к разрешенному адресу из контекста запроса,
+// так url и проверка сертификата используют имя, а семейство адреса выбирается при разрешении
+// подключения к другим адресам (например, к прокси) выполняются как обычно
+func dialProbeAddress(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if target, ok := ctx.Value(dialAddressKey{}).(ProbeAddress); ok && target.IP != "" {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("split address %s: %w", addr, err)
+			}
+			if host == target.Host || host == target.IP {
+				addr = net.JoinHostPort(target.IP, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
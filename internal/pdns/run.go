@@ -1,162 +1,439 @@
-package pdns
-
-import (
-	"log/slog"
-	"main/pkg/web"
-	"net/http"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-)
-
-// Структура, где поля будут содержать дескрипторы метрик dns
-type DnsMetricsDesc struct {
-	AllSimpleClusters         *prometheus.Desc
-	AvailabileSimpleClusters  *prometheus.Desc
-	DisableSimpleClusters     *prometheus.Desc
-	MaintenanceSimpleClusters *prometheus.Desc
-	CodeFromRecursor          *prometheus.Desc
-	TtrFromRecursor           *prometheus.Desc
-}
-
-// глобальное определение конфигурации и ошибки чтения (если есть)
-var Config, ConfErr = GetConfig()
-
-// Реализация интерфейса collector
-// метод Describe возвращает описание(дескриптор) всех метрик собранных этим коллектором в выделенный канал
-func (DnsMetrics *DnsMetricsDesc) Describe(ch chan<- *prometheus.Desc) {
-	ch <- DnsMetrics.AllSimpleClusters // экземпляр DnsMetrics создается в функции NewDnsMetrics()
-	ch <- DnsMetrics.AvailabileSimpleClusters
-	ch <- DnsMetrics.DisableSimpleClusters
-	ch <- DnsMetrics.MaintenanceSimpleClusters
-	ch <- DnsMetrics.CodeFromRecursor
-	ch <- DnsMetrics.TtrFromRecursor
-}
-
-// метод Collect возвращает в канал саму метрику и вызывается каждый раз при получении данных
-// так же возвращается дескриптор метрики
-// дескриптор, который передает Collect должен быть одним из тех, что возвращает Describe
-// метрики, использующе один и тот же дескриптор должны отличаться лейблами
-func (DnsMetrics *DnsMetricsDesc) Collect(ch chan<- prometheus.Metric) {
-	chAvailMgcl := make(chan []AvailabilityMegacluster)
-	chAvailUpstr := make(chan []AvailabilityRecursor)
-	go CheckAvailabilityAuth(Config.AuthClusters, Config.MtlsRequest, chAvailMgcl)
-	go CheckAvailabilityRecursor(Config.RecursorServers, chAvailUpstr)
-	resultCheckingAuth := <-chAvailMgcl
-	resultCheckingRecursor := <-chAvailUpstr
-	defer close(chAvailMgcl)
-	defer close(chAvailUpstr)
-	for _, item := range resultCheckingAuth {
-		// метрика - все кластеры в составе большого, которые получены из конфига
-		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
-			DnsMetrics.AllSimpleClusters,    // дескриптор
-			prometheus.GaugeValue,           // тип метрики
-			float64(item.AllSimpleClusters), // метрика
-			item.MegaClusterID,              // лейбл server представляет из себя ip адрес апстрима
-		)
-		// метрика - все доступные кластеры в составе большого
-		ch <- prometheus.MustNewConstMetric( // Метрика времени ответа сервера
-			DnsMetrics.AvailabileSimpleClusters,    // дескриптор
-			prometheus.GaugeValue,                  // тип метрики
-			float64(item.AvailabileSimpleClusters), // метрика в секундах
-			item.MegaClusterID,                     // лейбл server представляет из себя ip адрес апстрима
-		)
-		// метрика - все недоступные кластеры в составе большого
-		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
-			DnsMetrics.DisableSimpleClusters,    // дескриптор
-			prometheus.GaugeValue,               // тип метрики
-			float64(item.DisableSimpleClusters), // метрика
-			item.MegaClusterID,                  // лейбл server представляет из себя имя авторити кластера
-		)
-		// метрика - все кластеры на обслуживании в составе большого
-		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
-			DnsMetrics.MaintenanceSimpleClusters,    // дескриптор
-			prometheus.GaugeValue,                   // тип метрики
-			float64(item.MaintenanceSimpleClusters), // метрика
-			item.MegaClusterID,                      // лейбл server представляет из себя имя авторити кластера
-		)
-	}
-	for _, item := range resultCheckingRecursor {
-		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
-			DnsMetrics.CodeFromRecursor, // дескриптор
-			prometheus.GaugeValue,       // тип метрики
-			float64(item.Rcode),         // метрика
-			item.RecursorID,             // лейбл server представляет из себя ip адрес апстрима
-		)
-		ch <- prometheus.MustNewConstMetric( // Метрика времени ответа сервера
-			DnsMetrics.TtrFromRecursor, // дескриптор
-			prometheus.GaugeValue,      // тип метрики
-			float64(item.ResponseTime), // метрика в секундах
-			item.RecursorID,            // лейбл server представляет из себя ip адрес апстрима
-		)
-	}
-
-}
-
-// Создание нового объекта, структуры, полем которой является дескриптор (дескрипторы) метрик
-func NewDnsMetrics() *DnsMetricsDesc {
-	return &DnsMetricsDesc{
-		AllSimpleClusters: prometheus.NewDesc(
-			"all_simple_clusters", // имя метрики
-			"Общее количество кластеров днс в составе большого кластера", // хелп метрики
-			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
-			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
-		),
-		AvailabileSimpleClusters: prometheus.NewDesc(
-			"available_simple_clusters", // имя метрики
-			"Количество доступных кластеров днс в составе большого кластера", // хелп метрики
-			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
-			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
-		),
-		DisableSimpleClusters: prometheus.NewDesc(
-			"disable_simple_clusters", // имя метрики
-			"Количество недоступных кластеров днс в составе большого кластера", // хелп метрики
-			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
-			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
-		),
-		MaintenanceSimpleClusters: prometheus.NewDesc(
-			"maintenance_simple_clusters", // имя метрики
-			"Количество кластеров днс в составе большого кластера на обслуживании", // хелп метрики
-			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
-			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
-		),
-		CodeFromRecursor: prometheus.NewDesc(
-			"response_code_from_Recursor",         // имя метрики
-			"Код ответа от астрима или рекурсора", // хелп метрики
-			[]string{"RecursorID"},                // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
-			prometheus.Labels{},                   // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
-		),
-		TtrFromRecursor: prometheus.NewDesc(
-			"ttr_from_Recursor", // имя метрики
-			"Время ответа от апстрима или рекурсора", // хелп метрики
-			[]string{"RecursorID"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
-			prometheus.Labels{},    // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
-		),
-	}
-}
-
-func Run() error {
-	if ConfErr != nil {
-		return ConfErr
-	}
-	initLogger(Config.LogPath, Config.LogLevel)
-	reg := prometheus.NewPedanticRegistry()
-	workerDns := NewDnsMetrics()
-	mtlsSett := web.MtlsSettings{
-		Enabled:   Config.MtlsExporter.Enabled,
-		Key:       Config.MtlsExporter.Key,
-		Cert:      Config.MtlsExporter.Cert,
-		AllowedCN: Config.MtlsExporter.AllowedCN,
-	}
-	reg.MustRegister(workerDns)
-	promHandler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
-	http.Handle("/metrics", web.AuthenticationCN(promHandler, mtlsSett))
-	if Config.MtlsExporter.Enabled {
-		slog.Info("Run server with mtls.")
-		RunServerWithTls(promHandler, Config.MtlsExporter)
-	} else {
-		slog.Info("Run server without mtls.")
-		RunServerWithousTls(promHandler)
-	}
-	return nil
-}
+package pdns
+
+import (
+	"log/slog"
+	"main/pkg/web"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Структура, где поля будут содержать дескрипторы метрик dns
+type DnsMetricsDesc struct {
+	AllSimpleClusters         *prometheus.Desc
+	AvailabileSimpleClusters  *prometheus.Desc
+	DisableSimpleClusters     *prometheus.Desc
+	MaintenanceSimpleClusters *prometheus.Desc
+	CodeFromRecursor          *prometheus.Desc
+	TtrFromRecursor           *prometheus.Desc
+	TtrMinFromRecursor        *prometheus.Desc
+	TtrMaxFromRecursor        *prometheus.Desc
+	JitterFromRecursor        *prometheus.Desc
+	PacketLossFromRecursor    *prometheus.Desc
+	AvailableRecursor         *prometheus.Desc
+	TtrMinAuthNode            *prometheus.Desc
+	TtrAvgAuthNode            *prometheus.Desc
+	TtrMaxAuthNode            *prometheus.Desc
+	JitterAuthNode            *prometheus.Desc
+	PacketLossAuthNode        *prometheus.Desc
+	PeerCertNotAfterAuthNode  *prometheus.Desc
+	PeerCertDaysAuthNode      *prometheus.Desc
+	PeerCertNotAfterRecursor  *prometheus.Desc
+	PeerCertDaysRecursor      *prometheus.Desc
+}
+
+// глобальное определение конфигурации и ошибки чтения (если есть), конфиг читается при запуске Run
+var (
+	Config  *Conf
+	ConfErr error
+)
+
+// Реализация интерфейса collector
+// метод Describe возвращает описание(дескриптор) всех метрик собранных этим коллектором в выделенный канал
+func (DnsMetrics *DnsMetricsDesc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- DnsMetrics.AllSimpleClusters // экземпляр DnsMetrics создается в функции NewDnsMetrics()
+	ch <- DnsMetrics.AvailabileSimpleClusters
+	ch <- DnsMetrics.DisableSimpleClusters
+	ch <- DnsMetrics.MaintenanceSimpleClusters
+	ch <- DnsMetrics.CodeFromRecursor
+	ch <- DnsMetrics.TtrFromRecursor
+	ch <- DnsMetrics.TtrMinFromRecursor
+	ch <- DnsMetrics.TtrMaxFromRecursor
+	ch <- DnsMetrics.JitterFromRecursor
+	ch <- DnsMetrics.PacketLossFromRecursor
+	ch <- DnsMetrics.AvailableRecursor
+	ch <- DnsMetrics.TtrMinAuthNode
+	ch <- DnsMetrics.TtrAvgAuthNode
+	ch <- DnsMetrics.TtrMaxAuthNode
+	ch <- DnsMetrics.JitterAuthNode
+	ch <- DnsMetrics.PacketLossAuthNode
+	ch <- DnsMetrics.PeerCertNotAfterAuthNode
+	ch <- DnsMetrics.PeerCertDaysAuthNode
+	ch <- DnsMetrics.PeerCertNotAfterRecursor
+	ch <- DnsMetrics.PeerCertDaysRecursor
+}
+
+// метод Collect возвращает в канал саму метрику и вызывается каждый раз при получении данных
+// так же возвращается дескриптор метрики
+// дескриптор, который передает Collect должен быть одним из тех, что возвращает Describe
+// метрики, использующе один и тот же дескриптор должны отличаться лейблами
+// опрос выполняется в фоне (RunProbeLoop), здесь отдаются результаты последнего цикла
+func (DnsMetrics *DnsMetricsDesc) Collect(ch chan<- prometheus.Metric) {
+	snapshot := GetSnapshot()
+	resultCheckingAuth := snapshot.Megaclusters
+	resultCheckingRecursor := snapshot.Recursors
+	for _, item := range resultCheckingAuth {
+		// метрика - все кластеры в составе большого, которые получены из конфига
+		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
+			DnsMetrics.AllSimpleClusters,    // дескриптор
+			prometheus.GaugeValue,           // тип метрики
+			float64(item.AllSimpleClusters), // метрика
+			item.MegaClusterID,              // лейбл server представляет из себя ip адрес апстрима
+		)
+		// метрика - все доступные кластеры в составе большого
+		ch <- prometheus.MustNewConstMetric( // Метрика времени ответа сервера
+			DnsMetrics.AvailabileSimpleClusters,    // дескриптор
+			prometheus.GaugeValue,                  // тип метрики
+			float64(item.AvailabileSimpleClusters), // метрика в секундах
+			item.MegaClusterID,                     // лейбл server представляет из себя ip адрес апстрима
+		)
+		// метрика - все недоступные кластеры в составе большого
+		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
+			DnsMetrics.DisableSimpleClusters,    // дескриптор
+			prometheus.GaugeValue,               // тип метрики
+			float64(item.DisableSimpleClusters), // метрика
+			item.MegaClusterID,                  // лейбл server представляет из себя имя авторити кластера
+		)
+		// метрика - все кластеры на обслуживании в составе большого
+		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
+			DnsMetrics.MaintenanceSimpleClusters,    // дескриптор
+			prometheus.GaugeValue,                   // тип метрики
+			float64(item.MaintenanceSimpleClusters), // метрика
+			item.MegaClusterID,                      // лейбл server представляет из себя имя авторити кластера
+		)
+		// метрики серии dns запросов по каждой ноде кластеров в составе большого
+		for _, simplecluster := range item.SimpleClusters {
+			for _, node := range simplecluster.Nodes {
+				// сертификат апи балансировщика, если запрос выполнялся по https
+				if node.PeerCert != nil {
+					certLabels := []string{item.MegaClusterID, simplecluster.ClusterID, node.Address, node.Role, node.Family, node.PeerCert.Subject, node.PeerCert.Issuer}
+					ch <- prometheus.MustNewConstMetric(DnsMetrics.PeerCertNotAfterAuthNode, prometheus.GaugeValue, float64(node.PeerCert.NotAfter.Unix()), certLabels...)
+					ch <- prometheus.MustNewConstMetric(DnsMetrics.PeerCertDaysAuthNode, prometheus.GaugeValue, daysRemaining(node.PeerCert.NotAfter), certLabels...)
+				}
+				if node.Role == roleBalancer { // балансировщик проверяется по http, статистики dns у него нет
+					continue
+				}
+				labels := []string{item.MegaClusterID, simplecluster.ClusterID, node.Address, node.Role, node.Family}
+				ch <- prometheus.MustNewConstMetric(DnsMetrics.TtrMinAuthNode, prometheus.GaugeValue, node.MinTTR.Seconds(), labels...)
+				ch <- prometheus.MustNewConstMetric(DnsMetrics.TtrAvgAuthNode, prometheus.GaugeValue, node.AvgTTR.Seconds(), labels...)
+				ch <- prometheus.MustNewConstMetric(DnsMetrics.TtrMaxAuthNode, prometheus.GaugeValue, node.MaxTTR.Seconds(), labels...)
+				ch <- prometheus.MustNewConstMetric(DnsMetrics.JitterAuthNode, prometheus.GaugeValue, node.Jitter.Seconds(), labels...)
+				ch <- prometheus.MustNewConstMetric(DnsMetrics.PacketLossAuthNode, prometheus.GaugeValue, node.PacketLoss, labels...)
+			}
+		}
+	}
+	for _, item := range resultCheckingRecursor {
+		ch <- prometheus.MustNewConstMetric( // Метрика кода ответа сервера
+			DnsMetrics.CodeFromRecursor, // дескриптор
+			prometheus.GaugeValue,       // тип метрики
+			float64(item.Rcode),         // метрика
+			item.RecursorID,             // лейбл server представляет из себя ip адрес апстрима
+			item.Family,                 // лейбл family - семейство опрошенного адреса (ipv4 или ipv6)
+		)
+		ch <- prometheus.MustNewConstMetric( // Метрика времени ответа сервера
+			DnsMetrics.TtrFromRecursor,  // дескриптор
+			prometheus.GaugeValue,       // тип метрики
+			item.ResponseTime.Seconds(), // метрика в секундах
+			item.RecursorID,             // лейбл server представляет из себя ip адрес апстрима
+			item.Family,                 // лейбл family - семейство опрошенного адреса (ipv4 или ipv6)
+		)
+		// метрики серии dns запросов к апстриму
+		ch <- prometheus.MustNewConstMetric(DnsMetrics.TtrMinFromRecursor, prometheus.GaugeValue, item.MinTTR.Seconds(), item.RecursorID, item.Family)
+		ch <- prometheus.MustNewConstMetric(DnsMetrics.TtrMaxFromRecursor, prometheus.GaugeValue, item.MaxTTR.Seconds(), item.RecursorID, item.Family)
+		ch <- prometheus.MustNewConstMetric(DnsMetrics.JitterFromRecursor, prometheus.GaugeValue, item.Jitter.Seconds(), item.RecursorID, item.Family)
+		ch <- prometheus.MustNewConstMetric(DnsMetrics.PacketLossFromRecursor, prometheus.GaugeValue, item.PacketLoss, item.RecursorID, item.Family)
+		// устойчивое состояние апстрима с учетом порогов failuresBeforeDown и successesBeforeUp
+		ch <- prometheus.MustNewConstMetric(DnsMetrics.AvailableRecursor, prometheus.GaugeValue, boolToFloat(item.Availability), item.RecursorID, item.Family)
+		// сертификат апстрима, опрашиваемого по DoT или DoH
+		if item.PeerCert != nil {
+			ch <- prometheus.MustNewConstMetric(DnsMetrics.PeerCertNotAfterRecursor, prometheus.GaugeValue, float64(item.PeerCert.NotAfter.Unix()), item.RecursorID, item.Family, item.PeerCert.Subject, item.PeerCert.Issuer)
+			ch <- prometheus.MustNewConstMetric(DnsMetrics.PeerCertDaysRecursor, prometheus.GaugeValue, daysRemaining(item.PeerCert.NotAfter), item.RecursorID, item.Family, item.PeerCert.Subject, item.PeerCert.Issuer)
+		}
+	}
+
+}
+
+// Создание нового объекта, структуры, полем которой является дескриптор (дескрипторы) метрик
+func NewDnsMetrics() *DnsMetricsDesc {
+	return &DnsMetricsDesc{
+		AllSimpleClusters: prometheus.NewDesc(
+			"all_simple_clusters", // имя метрики
+			"Общее количество кластеров днс в составе большого кластера", // хелп метрики
+			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
+			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
+		),
+		AvailabileSimpleClusters: prometheus.NewDesc(
+			"available_simple_clusters", // имя метрики
+			"Количество доступных кластеров днс в составе большого кластера", // хелп метрики
+			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
+			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
+		),
+		DisableSimpleClusters: prometheus.NewDesc(
+			"disable_simple_clusters", // имя метрики
+			"Количество недоступных кластеров днс в составе большого кластера", // хелп метрики
+			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
+			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
+		),
+		MaintenanceSimpleClusters: prometheus.NewDesc(
+			"maintenance_simple_clusters", // имя метрики
+			"Количество кластеров днс в составе большого кластера на обслуживании", // хелп метрики
+			[]string{"cluster"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
+			prometheus.Labels{}, // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
+		),
+		CodeFromRecursor: prometheus.NewDesc(
+			"response_code_from_Recursor",         // имя метрики
+			"Код ответа от астрима или рекурсора", // хелп метрики
+			[]string{"RecursorID", "family"},      // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
+			prometheus.Labels{},                   // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
+		),
+		TtrFromRecursor: prometheus.NewDesc(
+			"ttr_from_Recursor_seconds", // имя метрики
+			"Среднее время ответа от апстрима или рекурсора в секундах", // хелп метрики
+			[]string{"RecursorID", "family"}, // variableLabels, лейблы метрики в зависимости от входящих данных при формировании метрики в методе Collect()
+			prometheus.Labels{},              // constLabels, заранее определяемые лейблы метрик этого типа (опционально)
+		),
+		// метрики серии dns запросов, лейблы как у метрик выше
+		TtrMinFromRecursor: prometheus.NewDesc(
+			"ttr_min_from_Recursor_seconds",
+			"Минимальное время ответа от апстрима или рекурсора за цикл опроса в секундах",
+			[]string{"RecursorID", "family"},
+			prometheus.Labels{},
+		),
+		TtrMaxFromRecursor: prometheus.NewDesc(
+			"ttr_max_from_Recursor_seconds",
+			"Максимальное время ответа от апстрима или рекурсора за цикл опроса в секундах",
+			[]string{"RecursorID", "family"},
+			prometheus.Labels{},
+		),
+		JitterFromRecursor: prometheus.NewDesc(
+			"jitter_from_Recursor_seconds",
+			"Джиттер времени ответа от апстрима или рекурсора за цикл опроса в секундах",
+			[]string{"RecursorID", "family"},
+			prometheus.Labels{},
+		),
+		PacketLossFromRecursor: prometheus.NewDesc(
+			"packet_loss_from_Recursor_ratio",
+			"Доля потерянных запросов к апстриму или рекурсору за цикл опроса",
+			[]string{"RecursorID", "family"},
+			prometheus.Labels{},
+		),
+		AvailableRecursor: prometheus.NewDesc(
+			"available_Recursor",
+			"Доступность апстрима или рекурсора с учетом порогов смены состояния (1 - доступен)",
+			[]string{"RecursorID", "family"},
+			prometheus.Labels{},
+		),
+		TtrMinAuthNode: prometheus.NewDesc(
+			"ttr_min_auth_node_seconds",
+			"Минимальное время ответа ноды авторити кластера за цикл опроса в секундах",
+			[]string{"cluster", "simplecluster", "node", "role", "family"},
+			prometheus.Labels{},
+		),
+		TtrAvgAuthNode: prometheus.NewDesc(
+			"ttr_avg_auth_node_seconds",
+			"Среднее время ответа ноды авторити кластера за цикл опроса в секундах",
+			[]string{"cluster", "simplecluster", "node", "role", "family"},
+			prometheus.Labels{},
+		),
+		TtrMaxAuthNode: prometheus.NewDesc(
+			"ttr_max_auth_node_seconds",
+			"Максимальное время ответа ноды авторити кластера за цикл опроса в секундах",
+			[]string{"cluster", "simplecluster", "node", "role", "family"},
+			prometheus.Labels{},
+		),
+		JitterAuthNode: prometheus.NewDesc(
+			"jitter_auth_node_seconds",
+			"Джиттер времени ответа ноды авторити кластера за цикл опроса в секундах",
+			[]string{"cluster", "simplecluster", "node", "role", "family"},
+			prometheus.Labels{},
+		),
+		PacketLossAuthNode: prometheus.NewDesc(
+			"packet_loss_auth_node_ratio",
+			"Доля потерянных запросов к ноде авторити кластера за цикл опроса",
+			[]string{"cluster", "simplecluster", "node", "role", "family"},
+			prometheus.Labels{},
+		),
+		PeerCertNotAfterAuthNode: prometheus.NewDesc(
+			"peer_cert_not_after_auth_node_timestamp_seconds",
+			"Время окончания действия сертификата апи ноды авторити кластера в unix секундах, ближайшее в цепочке",
+			[]string{"cluster", "simplecluster", "node", "role", "family", "subject", "issuer"},
+			prometheus.Labels{},
+		),
+		PeerCertDaysAuthNode: prometheus.NewDesc(
+			"peer_cert_days_remaining_auth_node",
+			"Количество дней до окончания действия сертификата апи ноды авторити кластера, ближайшего в цепочке",
+			[]string{"cluster", "simplecluster", "node", "role", "family", "subject", "issuer"},
+			prometheus.Labels{},
+		),
+		PeerCertNotAfterRecursor: prometheus.NewDesc(
+			"peer_cert_not_after_Recursor_timestamp_seconds",
+			"Время окончания действия сертификата апстрима (DoT, DoH) в unix секундах, ближайшее в цепочке",
+			[]string{"RecursorID", "family", "subject", "issuer"},
+			prometheus.Labels{},
+		),
+		PeerCertDaysRecursor: prometheus.NewDesc(
+			"peer_cert_days_remaining_Recursor",
+			"Количество дней до окончания действия сертификата апстрима (DoT, DoH), ближайшего в цепочке",
+			[]string{"RecursorID", "family", "subject", "issuer"},
+			prometheus.Labels{},
+		),
+	}
+}
+
+// Функция создает реестр /metrics со всеми метриками экспортера
+func newExporterRegistry(workerDns *DnsMetricsDesc, buckets []float64) *prometheus.Registry {
+	reg := prometheus.NewPedanticRegistry()
+	// коллекторы, время сбора которых учитывается в exporter_scrape_collector_duration_seconds
+	scrape := &instrumentedCollector{}
+	scrape.add("dns", workerDns)
+	scrape.add("cert_expiry", certExpiryCollector{})
+	reg.MustRegister(scrape)
+	reg.MustRegister(selfCollectors()...)
+	reg.MustRegister(web.RejectedRequests)
+	reg.MustRegister(initProbeMetrics(buckets)...)
+	reg.MustRegister(certReloadCollectors()...)
+	reg.MustRegister(vaultCollectors()...)
+	reg.MustRegister(webhookNotifications)
+	reg.MustRegister(alertmanagerCollectors()...)
+	reg.MustRegister(pushgatewayPushes)
+	reg.MustRegister(remoteWriteCollectors()...)
+	reg.MustRegister(otlpExports)
+	reg.MustRegister(outputWrites)
+	return reg
+}
+
+func Run() error {
+	Config, ConfErr = GetConfig()
+	if ConfErr != nil {
+		return ConfErr
+	}
+	initLogger(Config.LogPath, Config.LogLevel)
+	workerDns := NewDnsMetrics()
+	mtlsSett := web.MtlsSettings{
+		Enabled:    Config.MtlsExporter.Enabled,
+		Key:        Config.MtlsExporter.Key,
+		Cert:       Config.MtlsExporter.Cert,
+		AllowedCN:  Config.MtlsExporter.AllowedCN,
+		AllowRules: Config.MtlsExporter.AllowRules,
+		ClientAuth: Config.MtlsExporter.ClientAuth,
+	}
+	if err := mtlsSett.Validate(); err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	credentials, err := web.NewCredentialStore(Config.WebAuth)
+	if err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	ipFilter, err := web.NewIPFilter(Config.IPFilter)
+	if err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	tenants, err := newTenantFilters(Config.Tenants)
+	if err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	reg := newExporterRegistry(workerDns, Config.ResponseTimeBuckets)
+	reloadInterval := time.Duration(Config.CertReloadInterval) * time.Second
+	if len(Config.WebAuth.BearerTokenFiles) > 0 {
+		go credentials.Watch(reloadInterval)
+	}
+	if err := initRequestsCerts(Config, reloadInterval); err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	go RunSecretRefresh(Config)
+	if vault != nil {
+		go vault.RunRenew()
+	}
+	if len(Config.Webhooks) > 0 {
+		notifier, err := newWebhookNotifier(Config.Webhooks)
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		addCycleSink(notifier)
+	}
+	if len(Config.Alertmanager.URLs) > 0 {
+		alertSink, err := newAlertmanagerSink(Config, reloadInterval)
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		addCycleSink(alertSink)
+	}
+	if Config.Pushgateway.URL != "" {
+		pushSink, err := newPushgatewaySink(Config.Pushgateway, reg, reloadInterval)
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		addCycleSink(pushSink)
+		addShutdownHook(pushSink.Delete)
+	}
+	if Config.RemoteWrite.URL != "" {
+		remoteWriteSink, err := newRemoteWriteSink(Config.RemoteWrite, reg, reloadInterval)
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		addCycleSink(remoteWriteSink)
+	}
+	if Config.Otlp.URL != "" {
+		otlpSink, err := newOtlpSink(Config.Otlp, reg, reloadInterval)
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		addCycleSink(otlpSink)
+	}
+	// в выводы попадают только результаты опроса, без метрик самого экспортера
+	results := prometheus.NewRegistry()
+	results.MustRegister(workerDns)
+	for _, output := range Config.Outputs {
+		outputSink, err := newOutputSink(output, results, reloadInterval)
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		addCycleSink(outputSink)
+	}
+	go RunProbeLoop(Config)
+	promHandler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	if len(tenants) > 0 {
+		promHandler = TenantHandler(reg, tenants)
+	}
+	// в сервер передается mux целиком, чтобы запросы проходили проверку клиента по сертификату, паролю или токену
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", instrumentHandler("/metrics", web.AuthenticationCN(promHandler, mtlsSett, credentials)))
+	mux.Handle("/api/v1/status", instrumentHandler("/api/v1/status", web.AuthenticationCN(StatusHandler(tenants), mtlsSett, credentials)))
+	mux.Handle("/", instrumentHandler("/", web.AuthenticationCN(StatusPageHandler(tenants, Config.ProbeInterval), mtlsSett, credentials)))
+	// проверки для оркестратора без аутентификации, фильтр по адресу клиента к ним применяется
+	mux.Handle("/-/healthy", instrumentHandler("/-/healthy", HealthyHandler()))
+	mux.Handle("/-/ready", instrumentHandler("/-/ready", ReadyHandler()))
+	// фильтр по адресу клиента применяется ко всем эндпоинтам экспортера
+	handler := web.FilterIP(mux, ipFilter)
+	var serverErr error
+	if Config.MtlsExporter.Enabled {
+		slog.Info("Run server with mtls.")
+		exporterCerts, err := NewCertReloader("exporter", Config.MtlsExporter.Cert, Config.MtlsExporter.Key, exporterClientCA(Config.MtlsExporter))
+		if err != nil {
+			slog.Error(err.Error())
+			return err
+		}
+		go exporterCerts.Watch(reloadInterval)
+		serverErr = RunServerWithTls(handler, Config.MtlsExporter, exporterCerts)
+	} else {
+		slog.Info("Run server without mtls.")
+		serverErr = RunServerWithousTls(handler)
+	}
+	if serverErr != nil {
+		slog.Error(serverErr.Error())
+	}
+	return serverErr
+}
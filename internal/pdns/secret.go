@@ -0,0 +1,237 @@
+package pdns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Секрет из конфига: строка-литерал или ссылка env:NAME, file:/path, exec:command, vault:<mount>/<path>#<field>
+// значение разрешается при загрузке конфига и обновляется в фоне, в json и журнал секрет не попадает
+type Secret struct {
+	*secretValue
+}
+
+type secretValue struct {
+	ref   string // строка из конфига
+	mu    sync.RWMutex
+	value string
+}
+
+// Источник секретов по схеме ссылки
+type secretProvider interface {
+	Fetch(path string) (string, error)
+}
+
+// Поддерживаемые схемы ссылок, строка без известной схемы считается литералом
+// ссылка vault: без настроенного подключения к vault не разрешается, см. initVault
+var secretProviders = map[string]secretProvider{
+	"env":   envSecretProvider{},
+	"file":  fileSecretProvider{},
+	"exec":  execSecretProvider{},
+	"vault": vaultSecretProvider{},
+}
+
+// интервал проверки секретов на изменение по умолчанию, в секундах
+const defaultSecretRefreshInterval = 60
+
+// максимальное время выполнения команды exec:
+const secretExecTimeout = 10 * time.Second
+
+const redactedSecret = "<redacted>"
+
+func (secret *Secret) UnmarshalJSON(data []byte) error {
+	var ref string
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	secret.secretValue = &secretValue{ref: ref}
+	return nil
+}
+
+// Функция отдает ссылку на секрет, литерал заменяется на <redacted>
+func (secret Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(secret.String())
+}
+
+func (secret Secret) String() string {
+	if secret.secretValue == nil {
+		return ""
+	}
+	if _, _, ok := secret.reference(); ok {
+		return secret.ref
+	}
+	return redactedSecret
+}
+
+func (secret Secret) LogValue() slog.Value {
+	return slog.StringValue(secret.String())
+}
+
+// Функция проверяет, что секрет задан в конфиге непустой строкой
+// validate:"required" на структуре Secret не срабатывает, поэтому обязательные секреты проверяются этой функцией
+func (secret Secret) isSet() bool {
+	return secret.secretValue != nil && secret.ref != ""
+}
+
+// Функция возвращает текущее значение секрета
+func (secret Secret) Value() string {
+	if secret.secretValue == nil {
+		return ""
+	}
+	secret.mu.RLock()
+	defer secret.mu.RUnlock()
+	return secret.value
+}
+
+// Функция разбирает ссылку на схему и путь, ok - false для литерала
+func (secret Secret) reference() (secretProvider, string, bool) {
+	scheme, path, found := strings.Cut(secret.ref, ":")
+	if !found {
+		return nil, "", false
+	}
+	provider, ok := secretProviders[scheme]
+	return provider, path, ok
+}
+
+// Функция получает значение секрета из источника, changed - значение отличается от предыдущего
+// при ошибке сохраняется предыдущее значение
+func (secret Secret) Resolve() (changed bool, err error) {
+	if secret.secretValue == nil {
+		return false, nil
+	}
+	value := secret.ref
+	if provider, path, ok := secret.reference(); ok {
+		if value, err = provider.Fetch(path); err != nil {
+			return false, fmt.Errorf("resolve secret %s: %w", secret.ref, err)
+		}
+		if value == "" {
+			return false, fmt.Errorf("resolve secret %s: empty value", secret.ref)
+		}
+	}
+	secret.mu.Lock()
+	defer secret.mu.Unlock()
+	changed = secret.value != value
+	secret.value = value
+	return changed, nil
+}
+
+// Функция возвращает токены апи кластеров
+func (conf *Conf) apiTokens() []Secret {
+	var tokens []Secret
+	for _, megacluster := range conf.AuthClusters {
+		for _, simplecluster := range megacluster.SimpleClusters {
+			tokens = append(tokens, simplecluster.ApiToken)
+		}
+	}
+	return tokens
+}
+
+// Функция возвращает все секреты конфига: токены апи, адреса вебхуков и учетные данные alertmanager, pushgateway, remote write, otlp и выводов
+func (conf *Conf) secrets() []Secret {
+	secrets := conf.apiTokens()
+	for _, receiver := range conf.Webhooks {
+		secrets = append(secrets, receiver.URL)
+	}
+	secrets = append(secrets, conf.Alertmanager.secrets()...)
+	secrets = append(secrets, conf.Pushgateway.secrets()...)
+	secrets = append(secrets, conf.RemoteWrite.secrets()...)
+	secrets = append(secrets, conf.Otlp.secrets()...)
+	for _, output := range conf.Outputs {
+		secrets = append(secrets, output.secrets()...)
+	}
+	return secrets
+}
+
+// Функция разрешает все секреты конфига, вызывается при загрузке
+func resolveSecrets(conf *Conf) error {
+	if err := initVault(conf.Vault); err != nil {
+		return err
+	}
+	for _, megacluster := range conf.AuthClusters {
+		for _, simplecluster := range megacluster.SimpleClusters {
+			if !simplecluster.ApiToken.isSet() {
+				return fmt.Errorf("cluster %s: apiToken is required", simplecluster.ClusterID)
+			}
+		}
+	}
+	for _, receiver := range conf.Webhooks {
+		if !receiver.URL.isSet() {
+			return fmt.Errorf("webhook %s: url is required", receiver.Name)
+		}
+	}
+	for _, secret := range conf.secrets() {
+		if _, err := secret.Resolve(); err != nil {
+			return err
+		}
+	}
+	for _, token := range conf.apiTokens() {
+		if _, _, ok := token.reference(); !ok && token.ref != "" {
+			slog.Warn("The api token is set as a literal in the config, use env:, file:, exec: or vault: references instead")
+		}
+	}
+	return nil
+}
+
+// Функция обновляет секреты с интервалом из конфига, при ошибке остается предыдущее значение
+func RunSecretRefresh(conf *Conf) {
+	ticker := time.NewTicker(time.Duration(conf.SecretRefreshInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, secret := range conf.secrets() {
+			changed, err := secret.Resolve()
+			if err != nil {
+				slog.Error(err.Error())
+				continue
+			}
+			if changed {
+				slog.Info(fmt.Sprintf("The secret %s has been updated", secret))
+			}
+		}
+	}
+}
+
+// Секрет из переменной окружения
+type envSecretProvider struct{}
+
+func (envSecretProvider) Fetch(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// Секрет из файла, пробелы и переводы строк по краям отбрасываются
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Fetch(path string) (string, error) {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// Секрет из вывода команды, команда выполняется без shell, аргументы разделяются пробелами
+type execSecretProvider struct{}
+
+func (execSecretProvider) Fetch(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
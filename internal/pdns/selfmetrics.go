@@ -0,0 +1,199 @@
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Версия и коммит сборки, задаются из main (build var), пусто - берется из сведений о сборке go
+var (
+	BuildVersion string
+	BuildCommit  string
+)
+
+// sha256 файла конфига, считается при загрузке
+var configHash string
+
+// Типы проверок для метрик самого экспортера
+const (
+	probeKindAuthDns     = "auth_dns"
+	probeKindAuthHttp    = "auth_http"
+	probeKindRecursorDns = "recursor_dns"
+)
+
+// Метрики самого экспортера
+var (
+	probesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "exporter_probes_total",
+			Help: "Количество выполненных проверок по типу и результату",
+		},
+		[]string{"type", "result"},
+	)
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "exporter_probe_duration_seconds",
+			Help:    "Длительность проверки (серии dns запросов или http запроса) по типу",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"type"},
+	)
+	probesInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "exporter_probes_in_flight",
+			Help: "Количество выполняющихся проверок по типу",
+		},
+		[]string{"type"},
+	)
+	probeCycleDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "exporter_probe_cycle_duration_seconds",
+			Help: "Длительность последнего цикла опроса",
+		},
+	)
+	probeCycleLast = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "exporter_probe_cycle_last_timestamp_seconds",
+			Help: "Время завершения последнего цикла опроса в unix секундах",
+		},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "exporter_http_request_duration_seconds",
+			Help:    "Длительность обработки запросов к эндпоинтам экспортера",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler", "method", "code"},
+	)
+	scrapeCollectorDurationDesc = prometheus.NewDesc(
+		"exporter_scrape_collector_duration_seconds",
+		"Длительность сбора метрик коллектором",
+		[]string{"collector"},
+		prometheus.Labels{},
+	)
+	scrapeCollectorSuccessDesc = prometheus.NewDesc(
+		"exporter_scrape_collector_success",
+		"Результат сбора метрик коллектором (1 - успешно)",
+		[]string{"collector"},
+		prometheus.Labels{},
+	)
+)
+
+// Функция возвращает версию и коммит сборки
+func buildInfo() (string, string) {
+	version, commit := BuildVersion, BuildCommit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && commit == "" {
+				commit = setting.Value
+			}
+		}
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	return version, commit
+}
+
+// Функция создает метрики build_info и хеша конфига
+func newBuildInfoCollectors() []prometheus.Collector {
+	version, commit := buildInfo()
+	slog.Info(fmt.Sprintf("Exporter version %s, commit %s, config sha256 %s", version, commit, configHash))
+	buildInfoGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "exporter_build_info",
+		Help:        "Версия и коммит сборки экспортера, значение всегда 1",
+		ConstLabels: prometheus.Labels{"version": version, "commit": commit, "goversion": runtime.Version()},
+	})
+	buildInfoGauge.Set(1)
+	configHashGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "exporter_config_info",
+		Help:        "sha256 загруженного файла конфига, значение всегда 1",
+		ConstLabels: prometheus.Labels{"sha256": configHash},
+	})
+	configHashGauge.Set(1)
+	return []prometheus.Collector{buildInfoGauge, configHashGauge}
+}
+
+// Коллектор-обертка, отдает метрики вложенных коллекторов, длительность и результат сбора каждого из них
+// сбор считается неудачным, если коллектор упал с паникой
+type instrumentedCollector struct {
+	names []string
+	inner []prometheus.Collector
+}
+
+// Функция добавляет вложенный коллектор с именем для лейбла collector
+func (collector *instrumentedCollector) add(name string, inner prometheus.Collector) {
+	collector.names = append(collector.names, name)
+	collector.inner = append(collector.inner, inner)
+}
+
+func (collector *instrumentedCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, inner := range collector.inner {
+		inner.Describe(ch)
+	}
+	ch <- scrapeCollectorDurationDesc
+	ch <- scrapeCollectorSuccessDesc
+}
+
+func (collector *instrumentedCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, inner := range collector.inner {
+		start := time.Now()
+		success := collectSafe(collector.names[i], inner, ch)
+		ch <- prometheus.MustNewConstMetric(scrapeCollectorDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds(), collector.names[i])
+		ch <- prometheus.MustNewConstMetric(scrapeCollectorSuccessDesc, prometheus.GaugeValue, boolToFloat(success), collector.names[i])
+	}
+}
+
+func collectSafe(name string, inner prometheus.Collector, ch chan<- prometheus.Metric) (success bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error(fmt.Sprintf("The %s collector failed: %v", name, r))
+			success = false
+		}
+	}()
+	inner.Collect(ch)
+	return true
+}
+
+// Функция начинает учет проверки, возвращает функцию завершения с результатом проверки
+func startProbe(kind string) func(ok bool) {
+	start := time.Now()
+	probesInFlight.WithLabelValues(kind).Inc()
+	return func(ok bool) {
+		probesInFlight.WithLabelValues(kind).Dec()
+		probeDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+		result := "success"
+		if !ok {
+			result = "failure"
+		}
+		probesTotal.WithLabelValues(kind, result).Inc()
+	}
+}
+
+// Функция добавляет учет длительности запросов к эндпоинту экспортера
+func instrumentHandler(name string, handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(prometheus.Labels{"handler": name}), handler)
+}
+
+// Функция возвращает метрики самого экспортера для регистрации, включая коллекторы go и процесса
+func selfCollectors() []prometheus.Collector {
+	return append(newBuildInfoCollectors(),
+		probesTotal, probeDuration, probesInFlight, probeCycleDuration, probeCycleLast, httpRequestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
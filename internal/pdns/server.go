@@ -1,78 +1,142 @@
-package pdns
-
-import (
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
-	"log"
-	"net/http"
-	"os"
-)
-
-func AuthenticationCN(next http.Handler, mtlsSetting MtlsExporter) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
-			var commonName = r.TLS.VerifiedChains[0][0].Subject.CommonName // Получаем CN
-			if ContainString(mtlsSetting.AllowedCN, commonName) {          // если CN прописал в конфиге - ОК
-				log.Printf("Authentification successful. CN: %s, Remote address: %s", commonName, r.RemoteAddr)
-				next.ServeHTTP(w, r) // если все ок - передаем запрос следующему обработчику
-			} else if len(mtlsSetting.AllowedCN) == 0 || !mtlsSetting.Enabled {
-				log.Printf("Mtls disable. Request without mtls successful. Remote address: %s", r.RemoteAddr)
-				next.ServeHTTP(w, r)
-			} else { // если CN не прописан в конфиге - возвращаем ошибку
-				log.Printf("Authentification failed - incorrect CN: %s, Remote address: %s", commonName, r.RemoteAddr)
-				w.WriteHeader(http.StatusForbidden)
-				w.Header().Set("Content-Type", "application/json")
-				response := make(map[string]string)
-				response["message"] = "Incorrect CN of the certificate"
-				jsonResponse, _ := json.Marshal(response)
-				w.Write(jsonResponse)
-			}
-		} else {
-			log.Printf("Mtls disable. Request without mtls successful. Remote address: %s", r.RemoteAddr)
-			next.ServeHTTP(w, r)
-		}
-	})
-}
-
-func RunServerWithTls(handler http.Handler, mtlsSetting MtlsExporter) error {
-	// Create a CA certificate pool and add cert.pem to it
-	caCert, err := os.ReadFile(mtlsSetting.Cert)
-	if err != nil {
-		log.Printf("%s", err)
-	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	// Create the TLS Config with the CA pool and enable Client certificate validation
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		MinVersion: tls.VersionTLS12,
-		ClientAuth: tls.RequireAndVerifyClientCert,
-	}
-
-	// Create a Server instance to listen on port 8443 with the TLS config
-	server := &http.Server{
-		Addr:      ":9100",
-		TLSConfig: tlsConfig,
-	}
-
-	// Listen to HTTPS connections with the server certificate and wait
-	serverErr := server.ListenAndServeTLS(mtlsSetting.Cert, mtlsSetting.Key)
-	if serverErr != nil {
-		return serverErr
-	}
-	return nil
-}
-
-func RunServerWithousTls(handler http.Handler) error {
-	server := &http.Server{
-		Addr:    ":9100",
-		Handler: handler,
-	}
-	serverErr := server.ListenAndServe()
-	if serverErr != nil {
-		return serverErr
-	}
-	return nil
-}
+package pdns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// Функция запускает сервер экспортера с tls, все запросы проходят через handler (в нем проверка CN клиента)
+// сертификат сервера и пул ca клиентов берутся из CertReloader и обновляются без перезапуска
+func RunServerWithTls(handler http.Handler, mtlsSetting MtlsExporter, certs *CertReloader) error {
+	tlsConfig, err := createServerTlsConfig(mtlsSetting, certs)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:      ":9100",
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	// Listen to HTTPS connections, the certificate is provided by GetCertificate
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	listenerUp.Store(true)
+	go waitShutdown(server)
+	return serveResult(server.ServeTLS(listener, "", ""))
+}
+
+// Функция создает tls конфиг сервера экспортера: режим проверки клиентского сертификата,
+// минимальную версию tls и наборы шифров, сертификат и пул ca клиентов берутся из CertReloader
+func createServerTlsConfig(mtlsSetting MtlsExporter, certs *CertReloader) (*tls.Config, error) {
+	clientAuth, err := parseClientAuth(mtlsSetting.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	minVersion, err := parseTlsVersion(mtlsSetting.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(mtlsSetting.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		ClientAuth:     clientAuth,
+		CipherSuites:   cipherSuites,
+		GetCertificate: certs.GetCertificate,
+	}
+	if clientAuth == tls.NoClientCert {
+		return tlsConfig, nil
+	}
+	// на каждое подключение отдается копия конфига с текущим пулом ca клиентов
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		connConfig := tlsConfig.Clone()
+		connConfig.ClientCAs = certs.CAPool()
+		return connConfig, nil
+	}
+	return tlsConfig, nil
+}
+
+// Функция возвращает путь к бандлу ca клиентов, пустая строка - клиентские сертификаты не проверяются
+func exporterClientCA(mtlsSetting MtlsExporter) string {
+	if mtlsSetting.ClientAuth == "none" {
+		return ""
+	}
+	// для совместимости со старыми конфигами без clientCA пул собирается из сертификата сервера
+	if mtlsSetting.ClientCA == "" {
+		slog.Warn("clientCA is not set in mtlsExporter, the server certificate is used to verify clients")
+		return mtlsSetting.Cert
+	}
+	return mtlsSetting.ClientCA
+}
+
+// Функция переводит режим проверки клиентского сертификата из конфига, по умолчанию сертификат обязателен
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "request": // сертификат запрашивается и проверяется, если клиент его прислал
+		return tls.VerifyClientCertIfGiven, nil
+	case "none":
+		return tls.NoClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %s", mode)
+	}
+}
+
+// Функция переводит минимальную версию tls из конфига, по умолчанию 1.2
+func parseTlsVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown tls version %s", version)
+	}
+}
+
+// Функция переводит имена наборов шифров в их идентификаторы, пустой список - наборы по умолчанию
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func RunServerWithousTls(handler http.Handler) error {
+	server := &http.Server{
+		Addr:    ":9100",
+		Handler: handler,
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	listenerUp.Store(true)
+	go waitShutdown(server)
+	return serveResult(server.Serve(listener))
+}
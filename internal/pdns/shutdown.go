@@ -0,0 +1,49 @@
+package pdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// время на завершение обработки текущих запросов при остановке
+const shutdownTimeout = 10 * time.Second
+
+// функции, выполняемые при штатной остановке перед остановкой сервера (например, удаление группы в pushgateway)
+var shutdownHooks []func()
+
+// Функция добавляет функцию, выполняемую при штатной остановке
+func addShutdownHook(hook func()) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// Функция ждет SIGINT или SIGTERM, выполняет функции остановки и останавливает http сервер
+func waitShutdown(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	slog.Info(fmt.Sprintf("Received %s, shutting down", received))
+	listenerUp.Store(false)
+	for _, hook := range shutdownHooks {
+		hook()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error(fmt.Sprintf("Error stopping the server: %s", err))
+	}
+}
+
+// Функция возвращает ошибку сервера, штатная остановка ошибкой не считается
+func serveResult(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
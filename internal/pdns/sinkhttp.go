@@ -0,0 +1,122 @@
+package pdns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Настройки http клиента для отправки данных во внешние системы (alertmanager, pushgateway и другие)
+// Username и Password - basic auth, BearerToken - заголовок Authorization: Bearer, секреты - литерал или ссылка env:, file:, exec:, vault:
+// CACert - бандл ca сервера, Cert и Key - клиентский сертификат для mtls (перечитывается при изменении файлов)
+// Timeout - таймаут запроса в секундах
+type SinkHttpSettings struct {
+	Username    string `json:"username"`
+	Password    Secret `json:"password"`
+	BearerToken Secret `json:"bearerToken"`
+	CACert      string `json:"caCert"`
+	Cert        string `json:"cert" validate:"required_with=Key"`
+	Key         string `json:"key" validate:"required_with=Cert"`
+	Timeout     int    `json:"timeout" validate:"gte=0"`
+}
+
+// таймаут запросов во внешние системы по умолчанию
+const defaultSinkTimeout = 10 * time.Second
+
+// Функция возвращает секреты настроек для разрешения и обновления вместе с остальными секретами конфига
+func (settings SinkHttpSettings) secrets() []Secret {
+	return []Secret{settings.Password, settings.BearerToken}
+}
+
+// Http клиент с аутентификацией для отправки данных во внешние системы
+type sinkHttpClient struct {
+	settings SinkHttpSettings
+	client   *http.Client
+}
+
+// Функция создает клиент, source - имя для метрик перезагрузки клиентского сертификата
+func newSinkHttpClient(source string, settings SinkHttpSettings, reloadInterval time.Duration) (*sinkHttpClient, error) {
+	timeout := defaultSinkTimeout
+	if settings.Timeout > 0 {
+		timeout = time.Duration(settings.Timeout) * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch {
+	case settings.Cert != "":
+		certs, err := NewCertReloader(source, settings.Cert, settings.Key, settings.CACert)
+		if err != nil {
+			return nil, err
+		}
+		go certs.Watch(reloadInterval)
+		transport.TLSClientConfig = &tls.Config{RootCAs: certs.CAPool(), GetClientCertificate: certs.GetClientCertificate}
+	case settings.CACert != "":
+		caCert, err := os.ReadFile(settings.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("%s: no certificates found in %s", source, settings.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: caPool}
+	}
+	return &sinkHttpClient{
+		settings: settings,
+		client:   &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// Функция выполняет запрос, добавляя basic auth или bearer токен (используется и как push.HTTPDoer)
+// секреты берутся на каждый запрос, чтобы учитывать их обновление
+func (client *sinkHttpClient) Do(req *http.Request) (*http.Response, error) {
+	switch {
+	case client.settings.BearerToken.Value() != "":
+		req.Header.Set("Authorization", "Bearer "+client.settings.BearerToken.Value())
+	case client.settings.Username != "":
+		req.SetBasicAuth(client.settings.Username, client.settings.Password.Value())
+	}
+	return client.client.Do(req)
+}
+
+// Функция выполняет запрос с аутентификацией, ответ с кодом не 2xx возвращается как httpStatusError
+// адрес может содержать токен, поэтому в ошибку сети он не попадает
+func (client *sinkHttpClient) do(method, target, contentType string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// Функция определяет, имеет ли смысл повторить запрос: 429, 5xx или ошибка без ответа (сеть, tls, таймаут)
+func retryableSinkError(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Состояние цели опроса (маленький кластер или рекурсор), хранится между циклами опроса
+type TargetState struct {
+	Up                   bool
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+	Transitions          uint64
+	Since                time.Time // время последней смены состояния
+	LastFailure          string    // причина последней неудачной проверки
+	LastFailureAt        time.Time
+}
+
+// Смена состояния цели, последние смены хранятся в StateTracker
+type StateTransition struct {
+	Key string
+	Up  bool
+	At  time.Time
+}
+
+// количество последних смен состояния, которые хранятся для страницы статуса
+const transitionHistorySize = 100
+
+// Хранилище состояний целей, ключ - тип цели и ее идентификатор
+type StateTracker struct {
+	mu      sync.Mutex
+	states  map[string]*TargetState
+	history []StateTransition
+}
+
+// глобальное хранилище состояний, используется воркерами опроса
+var targetStates = NewStateTracker()
+
+// Создание пустого хранилища состояний
+func NewStateTracker() *StateTracker {
+	return &StateTracker{states: make(map[string]*TargetState)}
+}
+
+// Функция учитывает результат очередного цикла опроса и возвращает устойчивое состояние цели
+// changed - признак смены состояния в этом цикле, первый результат задает состояние без смены
+func (tracker *StateTracker) Update(key string, ok bool, hysteresis StateHysteresis) (up bool, changed bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	state, found := tracker.states[key]
+	if !found {
+		tracker.states[key] = &TargetState{Up: ok, Since: time.Now()}
+		return ok, false
+	}
+	if ok {
+		state.ConsecutiveSuccesses++
+		state.ConsecutiveFailures = 0
+	} else {
+		state.ConsecutiveFailures++
+		state.ConsecutiveSuccesses = 0
+	}
+	switch {
+	case state.Up && state.ConsecutiveFailures >= hysteresis.failures():
+		state.Up = false
+		changed = true
+	case !state.Up && state.ConsecutiveSuccesses >= hysteresis.successes():
+		state.Up = true
+		changed = true
+	}
+	if changed {
+		state.Transitions++
+		state.Since = time.Now()
+		tracker.history = append(tracker.history, StateTransition{Key: key, Up: state.Up, At: state.Since})
+		if len(tracker.history) > transitionHistorySize {
+			tracker.history = tracker.history[len(tracker.history)-transitionHistorySize:]
+		}
+		slog.Info(fmt.Sprintf("The state of %s has changed, available: %t", key, state.Up))
+	}
+	return state.Up, changed
+}
+
+// Функция запоминает причину неудачной проверки цели, вызывается после Update
+func (tracker *StateTracker) RecordFailure(key, failure string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if state, found := tracker.states[key]; found {
+		state.LastFailure = failure
+		state.LastFailureAt = time.Now()
+	}
+}
+
+// Функция возвращает копию состояния цели
+func (tracker *StateTracker) Get(key string) (TargetState, bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	state, found := tracker.states[key]
+	if !found {
+		return TargetState{}, false
+	}
+	return *state, true
+}
+
+// Функция возвращает последние смены состояния, новые - первыми
+func (tracker *StateTracker) Transitions() []StateTransition {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	transitions := make([]StateTransition, 0, len(tracker.history))
+	for i := len(tracker.history) - 1; i >= 0; i-- {
+		transitions = append(transitions, tracker.history[i])
+	}
+	return transitions
+}
+
+// Ключ состояния маленького кластера
+func simpleClusterStateKey(megaClusterID, clusterID string) string {
+	return fmt.Sprintf("auth/%s/%s", megaClusterID, clusterID)
+}
+
+// Ключ состояния рекурсора, семейства адресов dual-stack сервера отслеживаются отдельно
+func recursorStateKey(recursorID, family string) string {
+	return fmt.Sprintf("recursor/%s/%s", recursorID, family)
+}
@@ -0,0 +1,354 @@
+package pdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Вердикты политики доступности
+// маленький кластер и рекурсор: up или down по устойчивому состоянию, maintenance - кластер на обслуживании
+// группа: up - доступны все кластеры не на обслуживании, degraded - часть, down - ни одного, maintenance - все на обслуживании
+const (
+	verdictUp          = "up"
+	verdictDegraded    = "degraded"
+	verdictDown        = "down"
+	verdictMaintenance = "maintenance"
+)
+
+// Ответ /api/v1/status, Completed - время завершения последнего цикла опроса, null - циклов еще не было
+// Transitions - последние смены состояния кластеров и рекурсоров, новые - первыми
+type StatusResponse struct {
+	Completed   *time.Time         `json:"completed"`
+	Groups      []StatusGroup      `json:"groups"`
+	Recursors   []StatusRecursor   `json:"recursors"`
+	Transitions []StatusTransition `json:"transitions"`
+}
+
+// Статус группы (большого кластера) и счетчики маленьких кластеров в ее составе
+type StatusGroup struct {
+	GroupClusterID string          `json:"groupClusterID"`
+	Verdict        string          `json:"verdict"`
+	Total          int             `json:"total"`
+	Available      int             `json:"available"`
+	Unavailable    int             `json:"unavailable"`
+	Maintenance    int             `json:"maintenance"`
+	Clusters       []StatusCluster `json:"authClusters"`
+}
+
+// Статус маленького кластера, Available - устойчивое состояние, LastProbeOk - результат последнего цикла
+type StatusCluster struct {
+	ClusterID   string       `json:"clusterID"`
+	Verdict     string       `json:"verdict"`
+	Maintenance bool         `json:"maintenance"`
+	Available   bool         `json:"available"`
+	LastProbeOk bool         `json:"lastProbeOk"`
+	State       *StatusState `json:"state,omitempty"`
+	Nodes       []StatusNode `json:"nodes"`
+}
+
+// Сведения о смене состояния цели из StateTracker
+type StatusState struct {
+	Since                time.Time  `json:"since"`
+	ConsecutiveFailures  int        `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int        `json:"consecutiveSuccesses"`
+	Transitions          uint64     `json:"transitions"`
+	LastFailure          string     `json:"lastFailure,omitempty"`
+	LastFailureAt        *time.Time `json:"lastFailureAt,omitempty"`
+}
+
+// Результат последней проверки адреса: статистика серии dns запросов, rcode, код http ответа и причина отказа
+// время в секундах, как в метриках
+type StatusProbe struct {
+	ProbedAt          time.Time     `json:"probedAt"`
+	Sent              int           `json:"sent,omitempty"`
+	Received          int           `json:"received,omitempty"`
+	PacketLoss        float64       `json:"packetLoss,omitempty"`
+	LatencySeconds    float64       `json:"latencySeconds,omitempty"`
+	MinLatencySeconds float64       `json:"minLatencySeconds,omitempty"`
+	MaxLatencySeconds float64       `json:"maxLatencySeconds,omitempty"`
+	JitterSeconds     float64       `json:"jitterSeconds,omitempty"`
+	Rcode             string        `json:"rcode,omitempty"`
+	HttpCode          int16         `json:"httpCode,omitempty"`
+	FailureReason     FailureReason `json:"failureReason,omitempty"`
+	FailureDetail     string        `json:"failureDetail,omitempty"`
+	PeerCert          *PeerCert     `json:"peerCert,omitempty"`
+}
+
+// Статус ноды маленького кластера
+type StatusNode struct {
+	Role      string `json:"role"`
+	Address   string `json:"address"`
+	IP        string `json:"ip"`
+	Family    string `json:"family"`
+	Available bool   `json:"available"`
+	StatusProbe
+}
+
+// Статус рекурсора по семейству адресов
+type StatusRecursor struct {
+	RecursorID  string       `json:"recursorID"`
+	Address     string       `json:"address"`
+	Family      string       `json:"family"`
+	Verdict     string       `json:"verdict"`
+	Available   bool         `json:"available"`
+	LastProbeOk bool         `json:"lastProbeOk"`
+	State       *StatusState `json:"state,omitempty"`
+	StatusProbe
+}
+
+// Смена состояния цели, Target - ключ цели: auth/<группа>/<кластер> или recursor/<рекурсор>/<семейство>
+type StatusTransition struct {
+	Target string    `json:"target"`
+	Up     bool      `json:"up"`
+	At     time.Time `json:"at"`
+}
+
+// порядок нод в статусе
+var roleOrder = map[string]int{roleMaster: 0, roleSlave: 1, roleBalancer: 2}
+
+// Вердикт маленького кластера
+func simpleClusterVerdict(cluster AvailabilitySimpleCluster) string {
+	switch {
+	case cluster.Maintenance:
+		return verdictMaintenance
+	case cluster.Availability:
+		return verdictUp
+	default:
+		return verdictDown
+	}
+}
+
+// Вердикт группы, кластеры на обслуживании не учитываются
+func megaclusterVerdict(megacluster AvailabilityMegacluster) string {
+	var total, available int
+	for _, cluster := range megacluster.SimpleClusters {
+		if cluster.Maintenance {
+			continue
+		}
+		total++
+		if cluster.Availability {
+			available++
+		}
+	}
+	switch {
+	case total == 0:
+		return verdictMaintenance
+	case available == total:
+		return verdictUp
+	case available == 0:
+		return verdictDown
+	default:
+		return verdictDegraded
+	}
+}
+
+// Вердикт рекурсора
+func recursorVerdict(recursor AvailabilityRecursor) string {
+	if recursor.Availability {
+		return verdictUp
+	}
+	return verdictDown
+}
+
+// Функция возвращает имя rcode, пусто - ответ не получен
+func rcodeName(rcode int8) string {
+	if rcode == rcodeNoResponse {
+		return ""
+	}
+	return dns.RcodeToString[int(rcode)]
+}
+
+// Функция возвращает состояние цели из StateTracker, nil - цель еще не опрашивалась
+func statusState(key string) *StatusState {
+	state, found := targetStates.Get(key)
+	if !found {
+		return nil
+	}
+	status := &StatusState{
+		Since:                state.Since,
+		ConsecutiveFailures:  state.ConsecutiveFailures,
+		ConsecutiveSuccesses: state.ConsecutiveSuccesses,
+		Transitions:          state.Transitions,
+		LastFailure:          state.LastFailure,
+	}
+	if !state.LastFailureAt.IsZero() {
+		status.LastFailureAt = &state.LastFailureAt
+	}
+	return status
+}
+
+// Функция переносит статистику серии dns запросов в статус
+func newStatusProbe(probedAt time.Time, stats SampleStats) StatusProbe {
+	return StatusProbe{
+		ProbedAt:          probedAt,
+		Sent:              stats.Sent,
+		Received:          stats.Received,
+		PacketLoss:        stats.PacketLoss,
+		LatencySeconds:    stats.AvgTTR.Seconds(),
+		MinLatencySeconds: stats.MinTTR.Seconds(),
+		MaxLatencySeconds: stats.MaxTTR.Seconds(),
+		JitterSeconds:     stats.Jitter.Seconds(),
+	}
+}
+
+// Функция строит статус ноды маленького кластера
+func newStatusNode(node AvailabilityAuthNode) StatusNode {
+	probe := newStatusProbe(node.ProbedAt, node.SampleStats)
+	if node.Role != roleBalancer {
+		probe.Rcode = rcodeName(node.Rcode)
+	}
+	probe.HttpCode = node.HttpCode
+	probe.FailureReason = node.FailureReason
+	probe.FailureDetail = node.FailureDetail
+	probe.PeerCert = node.PeerCert
+	return StatusNode{
+		Role:        node.Role,
+		Address:     node.Address,
+		IP:          node.IP,
+		Family:      node.Family,
+		Available:   node.Availability,
+		StatusProbe: probe,
+	}
+}
+
+// Функция строит статус группы
+func newStatusGroup(megacluster AvailabilityMegacluster) StatusGroup {
+	group := StatusGroup{
+		GroupClusterID: megacluster.MegaClusterID,
+		Verdict:        megaclusterVerdict(megacluster),
+		Total:          int(megacluster.AllSimpleClusters),
+		Available:      int(megacluster.AvailabileSimpleClusters),
+		Unavailable:    int(megacluster.DisableSimpleClusters),
+		Maintenance:    int(megacluster.MaintenanceSimpleClusters),
+		Clusters:       []StatusCluster{},
+	}
+	for _, simplecluster := range megacluster.SimpleClusters {
+		cluster := StatusCluster{
+			ClusterID:   simplecluster.ClusterID,
+			Verdict:     simpleClusterVerdict(simplecluster),
+			Maintenance: simplecluster.Maintenance,
+			Available:   simplecluster.Availability,
+			LastProbeOk: simplecluster.RawAvailability,
+			State:       statusState(simpleClusterStateKey(megacluster.MegaClusterID, simplecluster.ClusterID)),
+			Nodes:       []StatusNode{},
+		}
+		for _, node := range simplecluster.Nodes {
+			cluster.Nodes = append(cluster.Nodes, newStatusNode(node))
+		}
+		sort.Slice(cluster.Nodes, func(i, j int) bool {
+			a, b := cluster.Nodes[i], cluster.Nodes[j]
+			if a.Role != b.Role {
+				return roleOrder[a.Role] < roleOrder[b.Role]
+			}
+			return a.Family < b.Family
+		})
+		group.Clusters = append(group.Clusters, cluster)
+	}
+	sort.Slice(group.Clusters, func(i, j int) bool { return group.Clusters[i].ClusterID < group.Clusters[j].ClusterID })
+	return group
+}
+
+// Функция строит статус рекурсора
+func newStatusRecursor(recursor AvailabilityRecursor) StatusRecursor {
+	probe := newStatusProbe(recursor.ProbedAt, recursor.SampleStats)
+	probe.Rcode = rcodeName(recursor.Rcode)
+	probe.FailureReason = recursor.FailureReason
+	probe.FailureDetail = recursor.FailureDetail
+	probe.PeerCert = recursor.PeerCert
+	return StatusRecursor{
+		RecursorID:  recursor.RecursorID,
+		Address:     recursor.Address,
+		Family:      recursor.Family,
+		Verdict:     recursorVerdict(recursor),
+		Available:   recursor.Availability,
+		LastProbeOk: recursor.RawAvailability,
+		State:       statusState(recursorStateKey(recursor.RecursorID, recursor.Family)),
+		StatusProbe: probe,
+	}
+}
+
+// Функция строит статус из результатов цикла опроса, tenants - команды клиента, nil - без фильтрации
+func buildStatus(snapshot ProbeSnapshot, tenants []*tenantFilter) StatusResponse {
+	status := StatusResponse{
+		Groups:      []StatusGroup{},
+		Recursors:   []StatusRecursor{},
+		Transitions: []StatusTransition{},
+	}
+	if !snapshot.Completed.IsZero() {
+		status.Completed = &snapshot.Completed
+	}
+	for _, megacluster := range snapshot.Megaclusters {
+		if tenants != nil && !tenantsAllowCluster(tenants, megacluster.MegaClusterID) {
+			continue
+		}
+		status.Groups = append(status.Groups, newStatusGroup(megacluster))
+	}
+	sort.Slice(status.Groups, func(i, j int) bool { return status.Groups[i].GroupClusterID < status.Groups[j].GroupClusterID })
+	for _, recursor := range snapshot.Recursors {
+		if tenants != nil && !tenantsAllowRecursor(tenants, recursor.RecursorID) {
+			continue
+		}
+		status.Recursors = append(status.Recursors, newStatusRecursor(recursor))
+	}
+	sort.Slice(status.Recursors, func(i, j int) bool {
+		a, b := status.Recursors[i], status.Recursors[j]
+		if a.RecursorID != b.RecursorID {
+			return a.RecursorID < b.RecursorID
+		}
+		return a.Family < b.Family
+	})
+	// в историю попадают только смены состояния целей, которые есть в статусе
+	visible := make(map[string]bool)
+	for _, group := range status.Groups {
+		for _, cluster := range group.Clusters {
+			visible[simpleClusterStateKey(group.GroupClusterID, cluster.ClusterID)] = true
+		}
+	}
+	for _, recursor := range status.Recursors {
+		visible[recursorStateKey(recursor.RecursorID, recursor.Family)] = true
+	}
+	for _, transition := range targetStates.Transitions() {
+		if visible[transition.Key] {
+			status.Transitions = append(status.Transitions, StatusTransition{Target: transition.Key, Up: transition.Up, At: transition.At})
+		}
+	}
+	return status
+}
+
+// Функция возвращает статус для клиента: при заданных командах - только их группы и рекурсоры
+// ok - false, если клиент не относится ни к одной команде (ответ 403 уже записан)
+func statusForRequest(w http.ResponseWriter, r *http.Request, tenants []*tenantFilter) (StatusResponse, bool) {
+	var matched []*tenantFilter
+	if len(tenants) > 0 {
+		var ok bool
+		if matched, ok = matchTenants(w, r, tenants); !ok {
+			return StatusResponse{}, false
+		}
+	}
+	return buildStatus(GetSnapshot(), matched), true
+}
+
+// Обработчик /api/v1/status, отдает дерево результатов последнего цикла опроса в json
+// токены апи в ответ не попадают
+func StatusHandler(tenants []*tenantFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ok := statusForRequest(w, r, tenants)
+		if !ok {
+			return
+		}
+		jsonResponse, err := json.Marshal(status)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error encoding the status: %s", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonResponse)
+	})
+}
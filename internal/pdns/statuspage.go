@@ -0,0 +1,175 @@
+package pdns
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Данные для шаблона страницы статуса
+type statusPageData struct {
+	StatusResponse
+	Version string
+	Refresh int // период автообновления страницы в секундах
+}
+
+// Функции шаблона страницы статуса
+var statusPageFuncs = template.FuncMap{
+	"time": func(value any) string {
+		var t time.Time
+		switch v := value.(type) {
+		case time.Time:
+			t = v
+		case *time.Time:
+			if v != nil {
+				t = *v
+			}
+		}
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	"ms": func(seconds float64) string {
+		return fmt.Sprintf("%.1f ms", seconds*1000)
+	},
+	"percent": func(value float64) string {
+		return fmt.Sprintf("%.0f%%", value*100)
+	},
+	"updown": func(up bool) string {
+		if up {
+			return verdictUp
+		}
+		return verdictDown
+	},
+}
+
+// Страница статуса для экранов дежурной смены, все стили встроены, внешние ресурсы не используются
+var statusPageTemplate = template.Must(template.New("status").Funcs(statusPageFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>group-dns-exporter status</title>
+<style>
+body { font-family: sans-serif; margin: 16px; background: #f4f5f7; color: #222; }
+h1 { font-size: 20px; margin: 0 0 4px; }
+h2 { font-size: 17px; margin: 24px 0 8px; }
+.meta { color: #666; font-size: 13px; }
+.group { background: #fff; border-radius: 6px; padding: 10px 14px; margin-bottom: 12px; border-left: 8px solid #999; }
+.cluster { border-left: 6px solid #999; padding: 6px 10px; margin: 8px 0; background: #fafafa; }
+.up { border-color: #2e9d4a; }
+.degraded { border-color: #e39b14; }
+.down { border-color: #d0342c; }
+.maintenance { border-color: #7a7f87; }
+.badge { display: inline-block; padding: 1px 7px; border-radius: 9px; font-size: 12px; color: #fff; background: #7a7f87; margin-left: 6px; }
+.badge.up { background: #2e9d4a; }
+.badge.degraded { background: #e39b14; }
+.badge.down { background: #d0342c; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+th, td { text-align: left; padding: 3px 8px; border-bottom: 1px solid #e3e4e8; }
+th { color: #555; font-weight: normal; }
+td.up { color: #2e9d4a; }
+td.down { color: #d0342c; }
+.reason { color: #d0342c; }
+.detail { color: #666; }
+</style>
+</head>
+<body>
+<h1>group-dns-exporter</h1>
+<div class="meta">version {{.Version}}, last probe cycle: {{if .Completed}}{{time .Completed}}{{else}}not completed yet{{end}}</div>
+
+<h2>Authoritative groups</h2>
+{{range .Groups}}
+<div class="group {{.Verdict}}">
+<b>{{.GroupClusterID}}</b><span class="badge {{.Verdict}}">{{.Verdict}}</span>
+<span class="meta">{{.Available}} of {{.Total}} clusters available{{if .Maintenance}}, {{.Maintenance}} in maintenance{{end}}</span>
+{{range .Clusters}}
+<div class="cluster {{.Verdict}}">
+<b>{{.ClusterID}}</b><span class="badge {{.Verdict}}">{{.Verdict}}</span>{{if .Maintenance}}<span class="badge maintenance">maintenance</span>{{end}}
+{{if ne .Available .LastProbeOk}}<span class="meta">last probe: {{updown .LastProbeOk}}</span>{{end}}
+{{with .State}}<span class="meta">since {{time .Since}}</span>
+{{if .LastFailure}}<div class="meta">last failure {{time .LastFailureAt}}: <span class="reason">{{.LastFailure}}</span></div>{{end}}{{end}}
+<table>
+<tr><th>role</th><th>address</th><th>ip</th><th>state</th><th>latency</th><th>loss</th><th>rcode / http</th><th>failure</th><th>probed</th></tr>
+{{range .Nodes}}
+<tr>
+<td>{{.Role}}</td><td>{{.Address}}</td><td>{{.IP}} ({{.Family}})</td>
+<td class="{{updown .Available}}">{{updown .Available}}</td>
+<td>{{if .Received}}{{ms .LatencySeconds}}{{else}}-{{end}}</td>
+<td>{{if .Sent}}{{percent .PacketLoss}}{{else}}-{{end}}</td>
+<td>{{if .Rcode}}{{.Rcode}}{{else if .HttpCode}}{{.HttpCode}}{{else}}-{{end}}</td>
+<td>{{if .FailureReason}}<span class="reason">{{.FailureReason}}</span> <span class="detail">{{.FailureDetail}}</span>{{end}}</td>
+<td>{{time .ProbedAt}}</td>
+</tr>
+{{end}}
+</table>
+</div>
+{{end}}
+</div>
+{{else}}
+<div class="meta">no results</div>
+{{end}}
+
+<h2>Recursors</h2>
+{{if .Recursors}}
+<table>
+<tr><th>recursor</th><th>address</th><th>state</th><th>latency</th><th>loss</th><th>rcode</th><th>failure</th><th>last failure</th><th>probed</th></tr>
+{{range .Recursors}}
+<tr>
+<td>{{.RecursorID}}</td><td>{{.Address}} ({{.Family}})</td>
+<td class="{{.Verdict}}">{{.Verdict}}{{if ne .Available .LastProbeOk}} <span class="meta">(last probe: {{updown .LastProbeOk}})</span>{{end}}</td>
+<td>{{if .Received}}{{ms .LatencySeconds}}{{else}}-{{end}}</td>
+<td>{{if .Sent}}{{percent .PacketLoss}}{{else}}-{{end}}</td>
+<td>{{if .Rcode}}{{.Rcode}}{{else}}-{{end}}</td>
+<td>{{if .FailureReason}}<span class="reason">{{.FailureReason}}</span> <span class="detail">{{.FailureDetail}}</span>{{end}}</td>
+<td>{{with .State}}{{if .LastFailure}}{{time .LastFailureAt}} <span class="detail">{{.LastFailure}}</span>{{end}}{{end}}</td>
+<td>{{time .ProbedAt}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<div class="meta">no results</div>
+{{end}}
+
+<h2>Recent state transitions</h2>
+{{if .Transitions}}
+<table>
+<tr><th>time</th><th>target</th><th>state</th></tr>
+{{range .Transitions}}
+<tr><td>{{time .At}}</td><td>{{.Target}}</td><td class="{{updown .Up}}">{{updown .Up}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<div class="meta">no state transitions since the start</div>
+{{end}}
+</body>
+</html>
+`))
+
+// Обработчик страницы статуса, страница строится из того же статуса, что и /api/v1/status
+// обрабатывается только корень, остальные пути - 404
+func StatusPageHandler(tenants []*tenantFilter, refresh int) http.Handler {
+	version, _ := buildInfo()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		status, ok := statusForRequest(w, r, tenants)
+		if !ok {
+			return
+		}
+		var page bytes.Buffer
+		if err := statusPageTemplate.Execute(&page, statusPageData{StatusResponse: status, Version: version, Refresh: refresh}); err != nil {
+			slog.Error(fmt.Sprintf("Error rendering the status page: %s", err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page.Bytes())
+	})
+}
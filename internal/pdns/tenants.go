@@ -0,0 +1,160 @@
+package pdns
+
+import (
+	"fmt"
+	"log/slog"
+	"main/pkg/web"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Лейблы, по которым фильтруются метрики команды
+const (
+	tenantClusterLabel  = "cluster"
+	tenantRecursorLabel = "RecursorID"
+	tenantSourceLabel   = "source" // source метрик сертификатов: requests/<группа>[/<кластер>] относится к группе
+	tenantWildcard      = "*"
+)
+
+// Команда с разобранными правилами сопоставления клиента
+type tenantFilter struct {
+	name      string
+	matcher   *web.IdentityMatcher
+	clusters  map[string]bool
+	recursors map[string]bool
+}
+
+// Функция разбирает команды из конфига
+func newTenantFilters(tenants []Tenant) ([]*tenantFilter, error) {
+	var filters []*tenantFilter
+	for _, tenant := range tenants {
+		matcher, err := web.NewIdentityMatcher(tenant.Users, tenant.AllowRules)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.Name, err)
+		}
+		filter := &tenantFilter{
+			name:      tenant.Name,
+			matcher:   matcher,
+			clusters:  make(map[string]bool),
+			recursors: make(map[string]bool),
+		}
+		for _, id := range tenant.GroupClusterIDs {
+			filter.clusters[id] = true
+		}
+		for _, id := range tenant.RecursorIDs {
+			filter.recursors[id] = true
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Функция возвращает true, если команде доступно значение лейбла
+func allowedValue(values map[string]bool, value string) bool {
+	return values[tenantWildcard] || values[value]
+}
+
+// Функция проверяет серию: метрики групп и рекурсоров должны быть доступны хотя бы одной команде клиента,
+// группа берется из лейбла cluster или из source метрик сертификатов групп,
+// метрики без группы и рекурсора (состояние самого экспортера) доступны всем
+func allowedMetric(metric *dto.Metric, tenants []*tenantFilter) bool {
+	for _, pair := range metric.GetLabel() {
+		var allowed bool
+		for _, tenant := range tenants {
+			switch pair.GetName() {
+			case tenantClusterLabel:
+				allowed = allowed || allowedValue(tenant.clusters, pair.GetValue())
+			case tenantRecursorLabel:
+				allowed = allowed || allowedValue(tenant.recursors, pair.GetValue())
+			case tenantSourceLabel:
+				group, ok := requestsSourceGroup(pair.GetValue())
+				allowed = allowed || !ok || allowedValue(tenant.clusters, group)
+			default:
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Функция оставляет в семействах метрик только доступные командам серии
+func filterFamilies(families []*dto.MetricFamily, tenants []*tenantFilter) []*dto.MetricFamily {
+	var filtered []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if allowedMetric(metric, tenants) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		family.Metric = metrics
+		filtered = append(filtered, family)
+	}
+	return filtered
+}
+
+// Функция возвращает команды клиента, клиент берется из контекста web.AuthenticationCN
+// клиент, не относящийся ни к одной команде, получает 403, ok - false
+func matchTenants(w http.ResponseWriter, r *http.Request, tenants []*tenantFilter) (matched []*tenantFilter, ok bool) {
+	identity, _ := web.IdentityFromContext(r.Context())
+	var names []string
+	for _, tenant := range tenants {
+		if tenant.matcher.Match(identity) {
+			matched = append(matched, tenant)
+			names = append(names, tenant.name)
+		}
+	}
+	if len(matched) == 0 {
+		web.RejectedRequests.WithLabelValues("no_tenant").Inc()
+		slog.Warn("Access decision", "decision", "deny", "reason", "no_tenant", "client_ip", web.ClientIP(r),
+			"method", r.Method, "path", r.URL.Path, "user", identity.User)
+		web.WriteDenied(w, http.StatusForbidden, "The client is not mapped to any tenant")
+		return nil, false
+	}
+	slog.Debug(fmt.Sprintf("Serving %s for tenants %v", r.URL.Path, names))
+	return matched, true
+}
+
+// Функция возвращает true, если группа доступна хотя бы одной из команд
+func tenantsAllowCluster(tenants []*tenantFilter, megaClusterID string) bool {
+	for _, tenant := range tenants {
+		if allowedValue(tenant.clusters, megaClusterID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция возвращает true, если рекурсор доступен хотя бы одной из команд
+func tenantsAllowRecursor(tenants []*tenantFilter, recursorID string) bool {
+	for _, tenant := range tenants {
+		if allowedValue(tenant.recursors, recursorID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Обработчик /metrics с фильтрацией по командам клиента
+func TenantHandler(gatherer prometheus.Gatherer, tenants []*tenantFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched, ok := matchTenants(w, r, tenants)
+		if !ok {
+			return
+		}
+		filtered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			families, err := gatherer.Gather()
+			return filterFamilies(families, matched), err
+		})
+		promhttp.HandlerFor(filtered, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
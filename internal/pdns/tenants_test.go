@@ -0,0 +1,180 @@
+package pdns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"main/pkg/web"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Функция создает самоподписанный сертификат и ключ в dir, возвращает пути к файлам
+func writeTestCert(t *testing.T, dir, commonName string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, commonName+".pem")
+	keyPath = filepath.Join(dir, commonName+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// Функция запрашивает /metrics через проверку клиента и фильтр команд, клиент задается bearer токеном
+func scrapeAsTenant(t *testing.T, handlerToken string, tenants []*tenantFilter, credentials *web.CredentialStore) string {
+	t.Helper()
+	reg := newExporterRegistry(NewDnsMetrics(), defaultResponseTimeBuckets)
+	observeAuthNode("group-a", "cluster-a", "10.0.0.1", roleMaster, DnsResponseData{Family: familyIPv4, Samples: []time.Duration{time.Millisecond}})
+	observeAuthNode("group-b", "cluster-b", "10.0.0.2", roleMaster, DnsResponseData{Family: familyIPv4, Samples: []time.Duration{time.Millisecond}})
+	handler := web.AuthenticationCN(TenantHandler(reg, tenants), web.MtlsSettings{}, credentials)
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+handlerToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestTenantHandlerHidesOtherGroups(t *testing.T) {
+	dir := t.TempDir()
+	sharedCert, sharedKey := writeTestCert(t, dir, "shared-client")
+	groupACert, groupAKey := writeTestCert(t, dir, "group-a-client")
+	groupBCert, groupBKey := writeTestCert(t, dir, "group-b-client")
+	clusterBCert, clusterBKey := writeTestCert(t, dir, "cluster-b-client")
+	conf := &Conf{
+		MtlsRequest: MtlsRequests{Enabled: true, Cert: sharedCert, Key: sharedKey, CA: sharedCert},
+		AuthClusters: []AuthCluster{
+			{
+				MegaClusterID:  "group-a",
+				SimpleClusters: []SimpleCluster{{ClusterID: "cluster-a"}},
+				RequestsTls:    RequestsTls{TlsCert: groupACert, TlsKey: groupAKey},
+			},
+			{
+				MegaClusterID: "group-b",
+				SimpleClusters: []SimpleCluster{
+					{ClusterID: "cluster-b"},
+					{ClusterID: "cluster-b2", RequestsTls: RequestsTls{TlsCert: clusterBCert, TlsKey: clusterBKey}},
+				},
+				RequestsTls: RequestsTls{TlsCert: groupBCert, TlsKey: groupBKey},
+			},
+		},
+	}
+	if err := initRequestsCerts(conf, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	snapshotMu.Lock()
+	lastSnapshot = ProbeSnapshot{
+		Megaclusters: []AvailabilityMegacluster{
+			{MegaClusterID: "group-a", SimpleClusters: []AvailabilitySimpleCluster{{ClusterID: "cluster-a"}}},
+			{MegaClusterID: "group-b", SimpleClusters: []AvailabilitySimpleCluster{{ClusterID: "cluster-b", Nodes: []AvailabilityAuthNode{
+				{Address: "balancer-b", Role: roleBalancer, Family: familyIPv4, PeerCert: &PeerCert{Subject: "api.group-b", Issuer: "ca-b", NotAfter: time.Now()}},
+			}}}},
+		},
+		Recursors: []AvailabilityRecursor{{RecursorID: "rec-a", Family: familyIPv4}, {RecursorID: "rec-b", Family: familyIPv4}},
+		Completed: time.Now(),
+	}
+	snapshotMu.Unlock()
+	t.Cleanup(func() {
+		snapshotMu.Lock()
+		lastSnapshot = ProbeSnapshot{}
+		snapshotMu.Unlock()
+	})
+
+	tokenA := filepath.Join(dir, "token-a")
+	tokenAll := filepath.Join(dir, "token-all")
+	os.WriteFile(tokenA, []byte("secret-a\n"), 0o600)
+	os.WriteFile(tokenAll, []byte("secret-all\n"), 0o600)
+	credentials, err := web.NewCredentialStore(web.Credentials{BearerTokenFiles: map[string]string{"team-a": tokenA, "noc": tokenAll}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := newTenantFilters([]Tenant{
+		{Name: "a", Users: []string{"team-a"}, GroupClusterIDs: []string{"group-a"}, RecursorIDs: []string{"rec-a"}},
+		{Name: "noc", Users: []string{"noc"}, GroupClusterIDs: []string{tenantWildcard}, RecursorIDs: []string{tenantWildcard}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := scrapeAsTenant(t, "secret-a", tenants, credentials)
+	for _, hidden := range []string{"group-b", "cluster-b", "rec-b", "api.group-b"} {
+		if strings.Contains(body, hidden) {
+			for _, line := range strings.Split(body, "\n") {
+				if strings.Contains(line, hidden) {
+					t.Errorf("team a sees %s: %s", hidden, line)
+				}
+			}
+		}
+	}
+	for _, visible := range []string{`source="requests/group-a"`, `cluster="group-a"`, `RecursorID="rec-a"`, `source="requests"`, "exporter_build_info"} {
+		if !strings.Contains(body, visible) {
+			t.Errorf("team a does not see %s", visible)
+		}
+	}
+
+	body = scrapeAsTenant(t, "secret-all", tenants, credentials)
+	for _, visible := range []string{`source="requests/group-b"`, `source="requests/group-b/cluster-b2"`, `cluster="group-b"`, `RecursorID="rec-b"`} {
+		if !strings.Contains(body, visible) {
+			t.Errorf("the wildcard tenant does not see %s", visible)
+		}
+	}
+}
+
+func TestAllowedMetricUnknownGroupSource(t *testing.T) {
+	tenants, err := newTenantFilters([]Tenant{{Name: "a", GroupClusterIDs: []string{"group-a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := func(name, value string) *dto.LabelPair { return &dto.LabelPair{Name: &name, Value: &value} }
+	cases := map[string]bool{
+		"exporter":                 true,
+		"requests":                 true,
+		"requests/unknown-group":   false,
+		"requests/unknown/cluster": false,
+	}
+	for source, want := range cases {
+		metric := &dto.Metric{Label: []*dto.LabelPair{label("source", source)}}
+		if got := allowedMetric(metric, tenants); got != want {
+			t.Errorf("source %s: allowed = %v, want %v", source, got, want)
+		}
+	}
+}
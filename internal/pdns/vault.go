@@ -0,0 +1,369 @@
+package pdns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Настройки подключения к HashiCorp Vault для ссылок vault:<mount>/<path>#<field> (KV v2)
+// аутентификация по токену (Token) или AppRole (RoleID и SecretID), Token и SecretID могут быть ссылками env: или file:
+// CacheTTL - время кеширования секрета в секундах, если vault не вернул lease_duration
+type VaultSettings struct {
+	Address      string `json:"address" validate:"omitempty,url"`
+	Namespace    string `json:"namespace"`
+	Token        Secret `json:"token"`
+	RoleID       Secret `json:"roleID"`
+	SecretID     Secret `json:"secretID"`
+	AppRoleMount string `json:"appRoleMount"`
+	CACert       string `json:"caCert"`
+	CacheTTL     int    `json:"cacheTTL" validate:"gte=0"`
+}
+
+// Значения по умолчанию для vault
+const (
+	defaultVaultAppRoleMount = "approle"
+	defaultVaultCacheTTL     = 300
+	vaultRequestTimeout      = 10 * time.Second
+	// повтор входа или продления токена после ошибки
+	vaultRetryInterval = 30 * time.Second
+)
+
+// Метрики обращений к vault, reason - auth, not_found, missing_field, http_error или request_error
+var (
+	vaultFetchFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vault_secret_fetch_failures_total",
+			Help: "Количество неудачных запросов секретов из vault по причине",
+		},
+		[]string{"reason"},
+	)
+	vaultFetches = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "vault_secret_fetches_total",
+			Help: "Количество запросов секретов из vault (без учета кеша)",
+		},
+	)
+	vaultTokenRenewals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vault_token_renewals_total",
+			Help: "Количество продлений и получений токена vault по результату",
+		},
+		[]string{"result"},
+	)
+)
+
+// Ошибка запроса к vault с причиной для метрики
+type vaultError struct {
+	reason string
+	err    error
+}
+
+func (err *vaultError) Error() string {
+	return err.err.Error()
+}
+
+// Закешированный секрет KV v2 (все поля версии)
+type vaultCacheEntry struct {
+	data    map[string]string
+	expires time.Time
+}
+
+// Клиент vault, используется источником секретов vault:
+type vaultClient struct {
+	settings   VaultSettings
+	httpClient *http.Client
+	mu         sync.Mutex
+	token      string
+	tokenTTL   time.Duration
+	renewable  bool
+	cache      map[string]vaultCacheEntry
+}
+
+// клиент vault, nil - vault не настроен
+var vault *vaultClient
+
+// Источник секретов vault:, запросы идут через клиент из initVault
+type vaultSecretProvider struct{}
+
+func (vaultSecretProvider) Fetch(path string) (string, error) {
+	if vault == nil {
+		return "", fmt.Errorf("vault is not configured, set vault.address in the config")
+	}
+	return vault.Fetch(path)
+}
+
+// Функция создает клиент vault и получает токен для источника секретов vault:
+func initVault(settings VaultSettings) error {
+	if settings.Address == "" {
+		return nil
+	}
+	for _, secret := range []Secret{settings.Token, settings.RoleID, settings.SecretID} {
+		if _, err := secret.Resolve(); err != nil {
+			return err
+		}
+	}
+	if settings.Token.Value() == "" && settings.RoleID.Value() == "" {
+		return fmt.Errorf("vault: token or roleID must be set")
+	}
+	if settings.AppRoleMount == "" {
+		settings.AppRoleMount = defaultVaultAppRoleMount
+	}
+	if settings.CacheTTL == 0 {
+		settings.CacheTTL = defaultVaultCacheTTL
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.CACert != "" {
+		caCert, err := os.ReadFile(settings.CACert)
+		if err != nil {
+			return fmt.Errorf("vault: %w", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("vault: no certificates found in %s", settings.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: caPool}
+	}
+	client := &vaultClient{
+		settings:   settings,
+		httpClient: &http.Client{Transport: transport, Timeout: vaultRequestTimeout},
+		cache:      make(map[string]vaultCacheEntry),
+	}
+	if err := client.login(); err != nil {
+		return err
+	}
+	vault = client
+	return nil
+}
+
+// Функция выполняет запрос к апи vault, out - структура для разбора ответа
+func (client *vaultClient) request(method, path, token string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return &vaultError{"request_error", err}
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(client.settings.Address, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return &vaultError{"request_error", err}
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if client.settings.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", client.settings.Namespace)
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return &vaultError{"request_error", err}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized:
+		return &vaultError{"auth", fmt.Errorf("vault %s %s: %s", method, path, resp.Status)}
+	case resp.StatusCode == http.StatusNotFound:
+		return &vaultError{"not_found", fmt.Errorf("vault %s %s: %s", method, path, resp.Status)}
+	case resp.StatusCode >= 300:
+		return &vaultError{"http_error", fmt.Errorf("vault %s %s: %s", method, path, resp.Status)}
+	}
+	if out == nil {
+		return nil
+	}
+	// числа секрета сохраняются в исходной записи, иначе float64 превращает 1000000 в 1e+06
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(out); err != nil {
+		return &vaultError{"request_error", fmt.Errorf("vault %s %s: %w", method, path, err)}
+	}
+	return nil
+}
+
+// Ответ vault с данными аутентификации
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Data struct {
+		TTL       int  `json:"ttl"`
+		Renewable bool `json:"renewable"`
+	} `json:"data"`
+}
+
+// Функция получает токен: вход по AppRole или проверка заданного токена (lookup-self)
+func (client *vaultClient) login() error {
+	var resp vaultAuthResponse
+	if client.settings.RoleID.Value() != "" {
+		body := map[string]string{"role_id": client.settings.RoleID.Value(), "secret_id": client.settings.SecretID.Value()}
+		if err := client.request("POST", fmt.Sprintf("auth/%s/login", client.settings.AppRoleMount), "", body, &resp); err != nil {
+			vaultTokenRenewals.WithLabelValues("failure").Inc()
+			return fmt.Errorf("vault approle login: %w", err)
+		}
+		client.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+	} else {
+		token := client.settings.Token.Value()
+		if err := client.request("GET", "auth/token/lookup-self", token, nil, &resp); err != nil {
+			vaultTokenRenewals.WithLabelValues("failure").Inc()
+			return fmt.Errorf("vault token lookup: %w", err)
+		}
+		client.setToken(token, resp.Data.TTL, resp.Data.Renewable)
+	}
+	vaultTokenRenewals.WithLabelValues("success").Inc()
+	return nil
+}
+
+// Функция продлевает текущий токен (renew-self)
+func (client *vaultClient) renew() error {
+	var resp vaultAuthResponse
+	if err := client.request("POST", "auth/token/renew-self", client.currentToken(), map[string]string{}, &resp); err != nil {
+		vaultTokenRenewals.WithLabelValues("failure").Inc()
+		return fmt.Errorf("vault token renew: %w", err)
+	}
+	client.setToken(client.currentToken(), resp.Auth.LeaseDuration, resp.Auth.Renewable)
+	vaultTokenRenewals.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (client *vaultClient) setToken(token string, ttl int, renewable bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.token = token
+	client.tokenTTL = time.Duration(ttl) * time.Second
+	client.renewable = renewable
+}
+
+func (client *vaultClient) currentToken() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.token
+}
+
+// Функция продлевает токен в фоне на половине срока его действия, после ошибки повторяет попытку через vaultRetryInterval
+// непродлеваемый токен AppRole получается заново, токен без срока действия не продлевается
+func (client *vaultClient) RunRenew() {
+	wait := client.renewWait()
+	for wait > 0 {
+		time.Sleep(wait)
+		client.mu.Lock()
+		renewable := client.renewable
+		client.mu.Unlock()
+		appRole := client.settings.RoleID.Value() != ""
+		var err error
+		switch {
+		case renewable:
+			if err = client.renew(); err != nil && appRole {
+				slog.Warn(fmt.Sprintf("%s, logging in again", err))
+				err = client.login()
+			}
+		case appRole:
+			err = client.login()
+		default:
+			slog.Warn("The vault token is not renewable and will expire")
+			return
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			wait = vaultRetryInterval
+			continue
+		}
+		wait = client.renewWait()
+	}
+	slog.Debug("The vault token has no ttl, renewal is not required")
+}
+
+// Функция возвращает время до следующего продления токена, 0 - токен бессрочный
+func (client *vaultClient) renewWait() time.Duration {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.tokenTTL / 2
+}
+
+// Функция возвращает поле секрета KV v2, ссылка: <mount>/<path>#<field>
+// секрет кешируется на lease_duration или cacheTTL, при ошибке запроса отдается устаревшее значение из кеша
+func (client *vaultClient) Fetch(ref string) (string, error) {
+	location, field, found := strings.Cut(ref, "#")
+	mount, path, hasPath := strings.Cut(location, "/")
+	if !found || !hasPath || field == "" {
+		return "", fmt.Errorf("vault reference must look like <mount>/<path>#<field>")
+	}
+	client.mu.Lock()
+	entry, cached := client.cache[location]
+	client.mu.Unlock()
+	if !cached || time.Now().After(entry.expires) {
+		fresh, err := client.read(mount, path)
+		if err != nil {
+			var vaultErr *vaultError
+			reason := "request_error"
+			if errors.As(err, &vaultErr) {
+				reason = vaultErr.reason
+			}
+			vaultFetchFailures.WithLabelValues(reason).Inc()
+			if !cached {
+				return "", err
+			}
+			slog.Warn(fmt.Sprintf("%s, the cached value is used", err))
+		} else {
+			entry = fresh
+			client.mu.Lock()
+			client.cache[location] = entry
+			client.mu.Unlock()
+		}
+	}
+	value, ok := entry.data[field]
+	if !ok {
+		vaultFetchFailures.WithLabelValues("missing_field").Inc()
+		return "", fmt.Errorf("field %s not found in vault secret %s", field, location)
+	}
+	return value, nil
+}
+
+// Функция читает последнюю версию секрета KV v2
+func (client *vaultClient) read(mount, path string) (vaultCacheEntry, error) {
+	var resp struct {
+		LeaseDuration int `json:"lease_duration"`
+		Data          struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	vaultFetches.Inc()
+	if err := client.request("GET", fmt.Sprintf("%s/data/%s", mount, path), client.currentToken(), nil, &resp); err != nil {
+		return vaultCacheEntry{}, err
+	}
+	ttl := resp.LeaseDuration
+	if ttl == 0 {
+		ttl = client.settings.CacheTTL
+	}
+	entry := vaultCacheEntry{
+		data:    make(map[string]string),
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	for key, value := range resp.Data.Data {
+		if str, ok := value.(string); ok {
+			entry.data[key] = str
+		} else {
+			entry.data[key] = fmt.Sprint(value)
+		}
+	}
+	return entry, nil
+}
+
+// Функция возвращает метрики vault для регистрации
+func vaultCollectors() []prometheus.Collector {
+	return []prometheus.Collector{vaultFetchFailures, vaultFetches, vaultTokenRenewals}
+}
@@ -0,0 +1,260 @@
+package pdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Тестовый vault: вход по AppRole, проверка токена, продление токена и чтение секрета KV v2 secret/app
+type fakeVault struct {
+	mu         sync.Mutex
+	password   string
+	reads      int
+	logins     int
+	failRead   bool
+	failRenew  bool
+	leaseTTL   int
+	tokenCount int
+}
+
+func (fake *fakeVault) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode login body: %s", err)
+		}
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fake.mu.Lock()
+		fake.logins++
+		fake.tokenCount++
+		token := fmt.Sprintf("token-%d", fake.tokenCount)
+		fake.mu.Unlock()
+		writeJSON(w, map[string]any{"auth": map[string]any{"client_token": token, "lease_duration": 3600, "renewable": true}})
+	})
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "static" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeJSON(w, map[string]any{"data": map[string]any{"ttl": 0, "renewable": false}})
+	})
+	mux.HandleFunc("/v1/auth/token/renew-self", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if fake.failRenew {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeJSON(w, map[string]any{"auth": map[string]any{"client_token": r.Header.Get("X-Vault-Token"), "lease_duration": 7200, "renewable": true}})
+	})
+	mux.HandleFunc("/v1/secret/data/app", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if !strings.HasPrefix(r.Header.Get("X-Vault-Token"), "token-") && r.Header.Get("X-Vault-Token") != "static" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fake.reads++
+		if fake.failRead {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"lease_duration": fake.leaseTTL,
+			"data":           map[string]any{"data": map[string]any{"password": fake.password, "port": 8081, "limit": 1000000, "ratio": 0.25, "enabled": true}},
+		})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func testSecret(ref string) Secret {
+	return Secret{&secretValue{ref: ref}}
+}
+
+// Функция поднимает тестовый vault и подключает к нему клиент по AppRole
+func startFakeVault(t *testing.T, fake *fakeVault) *vaultClient {
+	t.Helper()
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { vault = nil })
+	settings := VaultSettings{
+		Address:  server.URL,
+		RoleID:   testSecret("role"),
+		SecretID: testSecret("secret"),
+	}
+	if err := initVault(settings); err != nil {
+		t.Fatalf("initVault: %s", err)
+	}
+	return vault
+}
+
+func TestVaultAppRoleLogin(t *testing.T) {
+	fake := &fakeVault{password: "p1"}
+	client := startFakeVault(t, fake)
+	if client.currentToken() != "token-1" {
+		t.Errorf("token = %q, want token-1", client.currentToken())
+	}
+	if client.renewWait() != 30*time.Minute {
+		t.Errorf("renew wait = %s, want 30m", client.renewWait())
+	}
+	if !client.renewable {
+		t.Errorf("the approle token must be renewable")
+	}
+}
+
+func TestVaultAppRoleLoginDenied(t *testing.T) {
+	server := httptest.NewServer((&fakeVault{}).handler(t))
+	defer server.Close()
+	defer func() { vault = nil }()
+	err := initVault(VaultSettings{Address: server.URL, RoleID: testSecret("role"), SecretID: testSecret("wrong")})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("initVault error = %v, want 403", err)
+	}
+	if vault != nil {
+		t.Errorf("the vault client must not be set after a failed login")
+	}
+}
+
+func TestVaultTokenLookup(t *testing.T) {
+	server := httptest.NewServer((&fakeVault{password: "p1"}).handler(t))
+	defer server.Close()
+	defer func() { vault = nil }()
+	if err := initVault(VaultSettings{Address: server.URL, Token: testSecret("static")}); err != nil {
+		t.Fatalf("initVault: %s", err)
+	}
+	if vault.renewWait() != 0 {
+		t.Errorf("a token without ttl must not be renewed, renew wait = %s", vault.renewWait())
+	}
+	value, err := vault.Fetch("secret/app#password")
+	if err != nil || value != "p1" {
+		t.Errorf("Fetch = %q, %v, want p1", value, err)
+	}
+}
+
+func TestVaultFetchKV2(t *testing.T) {
+	fake := &fakeVault{password: "p1"}
+	startFakeVault(t, fake)
+	secret := testSecret("vault:secret/app#password")
+	if _, err := secret.Resolve(); err != nil {
+		t.Fatalf("Resolve: %s", err)
+	}
+	if secret.Value() != "p1" {
+		t.Errorf("value = %q, want p1", secret.Value())
+	}
+	for field, want := range map[string]string{"port": "8081", "limit": "1000000", "ratio": "0.25", "enabled": "true"} {
+		value := testSecret("vault:secret/app#" + field)
+		if _, err := value.Resolve(); err != nil || value.Value() != want {
+			t.Errorf("non-string field %s = %q, %v, want %s", field, value.Value(), err, want)
+		}
+	}
+	for _, ref := range []string{"vault:secret/app#missing", "vault:secret/other#password", "vault:secret/app", "vault:secret#password"} {
+		if _, err := testSecret(ref).Resolve(); err == nil {
+			t.Errorf("Resolve(%s) must fail", ref)
+		}
+	}
+}
+
+func TestVaultCacheTTL(t *testing.T) {
+	fake := &fakeVault{password: "p1"}
+	client := startFakeVault(t, fake)
+	for i := 0; i < 3; i++ {
+		if value, err := client.Fetch("secret/app#password"); err != nil || value != "p1" {
+			t.Fatalf("Fetch = %q, %v, want p1", value, err)
+		}
+	}
+	if fake.reads != 1 {
+		t.Errorf("reads = %d, want 1 while the cache is valid", fake.reads)
+	}
+	entry := client.cache["secret/app"]
+	if ttl := time.Until(entry.expires); ttl <= 0 || ttl > time.Duration(defaultVaultCacheTTL)*time.Second {
+		t.Errorf("cache ttl = %s, want up to the default %ds", ttl, defaultVaultCacheTTL)
+	}
+
+	// после истечения кеша секрет перечитывается
+	fake.password = "p2"
+	entry.expires = time.Now().Add(-time.Second)
+	client.cache["secret/app"] = entry
+	if value, _ := client.Fetch("secret/app#password"); value != "p2" {
+		t.Errorf("value after expiry = %q, want p2", value)
+	}
+	if fake.reads != 2 {
+		t.Errorf("reads = %d, want 2 after expiry", fake.reads)
+	}
+
+	// при ошибке vault отдается устаревшее значение из кеша
+	fake.failRead = true
+	entry = client.cache["secret/app"]
+	entry.expires = time.Now().Add(-time.Second)
+	client.cache["secret/app"] = entry
+	if value, err := client.Fetch("secret/app#password"); err != nil || value != "p2" {
+		t.Errorf("stale value = %q, %v, want p2", value, err)
+	}
+}
+
+func TestVaultCacheLeaseDuration(t *testing.T) {
+	fake := &fakeVault{password: "p1", leaseTTL: 5}
+	client := startFakeVault(t, fake)
+	if _, err := client.Fetch("secret/app#password"); err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if ttl := time.Until(client.cache["secret/app"].expires); ttl <= 0 || ttl > 5*time.Second {
+		t.Errorf("cache ttl = %s, want lease_duration 5s", ttl)
+	}
+}
+
+func TestVaultRenewFailure(t *testing.T) {
+	fake := &fakeVault{password: "p1"}
+	client := startFakeVault(t, fake)
+	if err := client.renew(); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if client.renewWait() != time.Hour {
+		t.Errorf("renew wait after renew = %s, want 1h", client.renewWait())
+	}
+
+	fake.failRenew = true
+	err := client.renew()
+	if err == nil || !strings.Contains(err.Error(), "vault token renew") {
+		t.Fatalf("renew error = %v, want a renew failure", err)
+	}
+	if client.currentToken() != "token-1" {
+		t.Errorf("token after a failed renew = %q, want token-1", client.currentToken())
+	}
+	// после неудачного продления токен AppRole получается заново входом
+	if err := client.login(); err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	if client.currentToken() != "token-2" || fake.logins != 2 {
+		t.Errorf("token = %q, logins = %d, want token-2 and 2 logins", client.currentToken(), fake.logins)
+	}
+}
+
+func TestVaultReferenceWithoutVault(t *testing.T) {
+	vault = nil
+	secret := testSecret("vault:secret/app#password")
+	if _, _, ok := secret.reference(); !ok {
+		t.Fatalf("vault: must be a known scheme without a configured vault")
+	}
+	_, err := secret.Resolve()
+	if err == nil || !strings.Contains(err.Error(), "vault is not configured") {
+		t.Errorf("Resolve error = %v, want vault is not configured", err)
+	}
+	if secret.Value() != "" {
+		t.Errorf("the reference must not be used as a literal, value = %q", secret.Value())
+	}
+}
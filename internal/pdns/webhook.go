@@ -0,0 +1,321 @@
+package pdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Получатель уведомлений о смене состояния маленьких кластеров и рекурсоров
+// Type - json (событие целиком или по шаблону) или slack (совместим с Mattermost, шаблон задает текст сообщения)
+// URL - адрес вебхука, литерал или ссылка env:, file:, exec:, vault:
+// Template - шаблон text/template, данные шаблона - StateEvent
+// GroupClusterIDs, RecursorIDs и Severities - фильтры событий, пусто - все, "*" - все
+// Retries - количество повторов отправки при ошибке сети, 429 или 5xx
+type WebhookReceiver struct {
+	Name            string   `json:"name" validate:"required"`
+	Type            string   `json:"type" validate:"omitempty,oneof=json slack"`
+	URL             Secret   `json:"url"` // обязателен
+	Template        string   `json:"template"`
+	Channel         string   `json:"channel"`
+	GroupClusterIDs []string `json:"groupClusterIDs"`
+	RecursorIDs     []string `json:"recursorIDs"`
+	Severities      []string `json:"severities" validate:"dive,oneof=critical warning info"`
+	Retries         *int     `json:"retries" validate:"omitempty,gte=0"`
+}
+
+// Значения по умолчанию для вебхуков
+const (
+	webhookTypeJson       = "json"
+	webhookTypeSlack      = "slack"
+	defaultWebhookRetries = 5
+	webhookTimeout        = 10 * time.Second
+	webhookBackoffStart   = time.Second
+	webhookBackoffMax     = time.Minute
+	// очередь событий получателя, при переполнении события отбрасываются
+	webhookQueueSize = 100
+)
+
+// Важность события: critical - недоступен кластер или рекурсор, и вся группа недоступна (для кластера),
+// warning - недоступен кластер, в группе есть доступные, info - восстановление
+const (
+	severityCritical = "critical"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+// Типы целей в событиях
+const (
+	targetAuthCluster = "auth_cluster"
+	targetRecursor    = "recursor"
+)
+
+// Текст сообщения slack по умолчанию
+const defaultSlackTemplate = `{{if eq .State "down"}}:red_circle:{{else}}:large_green_circle:{{end}} [{{.Severity}}] {{.Name}} is {{.State}}{{if .Failure}}: {{.Failure}}{{end}}`
+
+// Событие смены состояния цели
+// Name - имя для сообщений: <группа>/<кластер> или <рекурсор> (<семейство>), Target - ключ состояния цели
+// GroupVerdict - вердикт группы на момент события, Failure - причина последней неудачной проверки
+type StateEvent struct {
+	Kind         string    `json:"kind"`
+	Name         string    `json:"name"`
+	Target       string    `json:"target"`
+	Group        string    `json:"groupClusterID,omitempty"`
+	Cluster      string    `json:"clusterID,omitempty"`
+	RecursorID   string    `json:"recursorID,omitempty"`
+	Family       string    `json:"family,omitempty"`
+	State        string    `json:"state"`
+	Severity     string    `json:"severity"`
+	GroupVerdict string    `json:"groupVerdict,omitempty"`
+	Failure      string    `json:"failure,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// Метрики отправки уведомлений, result - sent, failed или dropped
+var webhookNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_notifications_total",
+		Help: "Количество уведомлений о смене состояния по получателю и результату",
+	},
+	[]string{"receiver", "result"},
+)
+
+// Получатель с разобранным шаблоном, фильтрами и очередью событий
+type webhookSender struct {
+	settings   WebhookReceiver
+	template   *template.Template
+	groups     map[string]bool
+	recursors  map[string]bool
+	severities map[string]bool
+	retries    int
+	queue      chan StateEvent
+	httpClient *http.Client
+}
+
+// Отправитель уведомлений, получает результаты каждого цикла опроса
+type webhookNotifier struct {
+	senders []*webhookSender
+}
+
+// Функция создает отправителей по настройкам получателей и запускает их очереди
+func newWebhookNotifier(receivers []WebhookReceiver) (*webhookNotifier, error) {
+	notifier := &webhookNotifier{}
+	for _, receiver := range receivers {
+		sender := &webhookSender{
+			settings:   receiver,
+			groups:     listToSet(receiver.GroupClusterIDs),
+			recursors:  listToSet(receiver.RecursorIDs),
+			severities: listToSet(receiver.Severities),
+			retries:    defaultWebhookRetries,
+			queue:      make(chan StateEvent, webhookQueueSize),
+			httpClient: &http.Client{Timeout: webhookTimeout},
+		}
+		if receiver.Retries != nil {
+			sender.retries = *receiver.Retries
+		}
+		text := receiver.Template
+		if text == "" && receiver.Type == webhookTypeSlack {
+			text = defaultSlackTemplate
+		}
+		if text != "" {
+			tmpl, err := template.New(receiver.Name).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", receiver.Name, err)
+			}
+			sender.template = tmpl
+		}
+		notifier.senders = append(notifier.senders, sender)
+		go sender.run()
+	}
+	return notifier, nil
+}
+
+// Функция превращает список идентификаторов в множество, пустой список - nil (без фильтра)
+func listToSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Функция возвращает true, если значение проходит фильтр, nil - фильтра нет
+func passFilter(filter map[string]bool, value string) bool {
+	return filter == nil || allowedValue(filter, value)
+}
+
+// Функция формирует события по целям, состояние которых сменилось в цикле, и ставит их в очереди получателей
+// кластеры на обслуживании уведомлений не порождают
+func (notifier *webhookNotifier) HandleCycle(snapshot ProbeSnapshot) {
+	for _, event := range stateEvents(snapshot) {
+		for _, sender := range notifier.senders {
+			if !sender.accepts(event) {
+				continue
+			}
+			select {
+			case sender.queue <- event:
+			default:
+				webhookNotifications.WithLabelValues(sender.settings.Name, "dropped").Inc()
+				slog.Error(fmt.Sprintf("The queue of the webhook %s is full, the notification about %s is dropped", sender.settings.Name, event.Name))
+			}
+		}
+	}
+}
+
+// Функция возвращает события смены состояния из результатов цикла
+func stateEvents(snapshot ProbeSnapshot) []StateEvent {
+	var events []StateEvent
+	for _, megacluster := range snapshot.Megaclusters {
+		verdict := megaclusterVerdict(megacluster)
+		for _, cluster := range megacluster.SimpleClusters {
+			if !cluster.Changed || cluster.Maintenance {
+				continue
+			}
+			event := StateEvent{
+				Kind:         targetAuthCluster,
+				Name:         fmt.Sprintf("%s/%s", megacluster.MegaClusterID, cluster.ClusterID),
+				Target:       simpleClusterStateKey(megacluster.MegaClusterID, cluster.ClusterID),
+				Group:        megacluster.MegaClusterID,
+				Cluster:      cluster.ClusterID,
+				GroupVerdict: verdict,
+				Time:         snapshot.Completed,
+			}
+			switch {
+			case cluster.Availability:
+				event.State, event.Severity = verdictUp, severityInfo
+			case verdict == verdictDown:
+				event.State, event.Severity = verdictDown, severityCritical
+			default:
+				event.State, event.Severity = verdictDown, severityWarning
+			}
+			events = append(events, withFailure(event))
+		}
+	}
+	for _, recursor := range snapshot.Recursors {
+		if !recursor.Changed {
+			continue
+		}
+		event := StateEvent{
+			Kind:       targetRecursor,
+			Name:       fmt.Sprintf("%s (%s)", recursor.RecursorID, recursor.Family),
+			Target:     recursorStateKey(recursor.RecursorID, recursor.Family),
+			RecursorID: recursor.RecursorID,
+			Family:     recursor.Family,
+			State:      verdictDown,
+			Severity:   severityCritical,
+			Time:       snapshot.Completed,
+		}
+		if recursor.Availability {
+			event.State, event.Severity = verdictUp, severityInfo
+		}
+		events = append(events, withFailure(event))
+	}
+	return events
+}
+
+// Функция добавляет в событие недоступности причину последней неудачной проверки
+func withFailure(event StateEvent) StateEvent {
+	if event.State == verdictDown {
+		if state, found := targetStates.Get(event.Target); found {
+			event.Failure = state.LastFailure
+		}
+	}
+	return event
+}
+
+// Функция проверяет событие по фильтрам получателя
+func (sender *webhookSender) accepts(event StateEvent) bool {
+	if !passFilter(sender.severities, event.Severity) {
+		return false
+	}
+	if event.Kind == targetRecursor {
+		return passFilter(sender.recursors, event.RecursorID)
+	}
+	return passFilter(sender.groups, event.Group)
+}
+
+// Функция отправляет события из очереди по одному, при ошибке повторяет с экспоненциальной паузой
+func (sender *webhookSender) run() {
+	for event := range sender.queue {
+		payload, err := sender.payload(event)
+		if err != nil {
+			webhookNotifications.WithLabelValues(sender.settings.Name, "failed").Inc()
+			slog.Error(fmt.Sprintf("Error building the webhook %s payload: %s", sender.settings.Name, err))
+			continue
+		}
+		backoff := webhookBackoffStart
+		for attempt := 0; ; attempt++ {
+			retry, err := sender.send(payload)
+			if err == nil {
+				webhookNotifications.WithLabelValues(sender.settings.Name, "sent").Inc()
+				slog.Info(fmt.Sprintf("The webhook %s has been notified: %s is %s", sender.settings.Name, event.Name, event.State))
+				break
+			}
+			if !retry || attempt >= sender.retries {
+				webhookNotifications.WithLabelValues(sender.settings.Name, "failed").Inc()
+				slog.Error(fmt.Sprintf("Error sending the webhook %s notification about %s: %s", sender.settings.Name, event.Name, err))
+				break
+			}
+			slog.Warn(fmt.Sprintf("Error sending the webhook %s notification, retry in %s: %s", sender.settings.Name, backoff, err))
+			time.Sleep(backoff)
+			backoff = min(backoff*2, webhookBackoffMax)
+		}
+	}
+}
+
+// Функция формирует тело запроса: json события, результат шаблона или сообщение slack
+func (sender *webhookSender) payload(event StateEvent) ([]byte, error) {
+	var rendered bytes.Buffer
+	if sender.template != nil {
+		if err := sender.template.Execute(&rendered, event); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case sender.settings.Type == webhookTypeSlack:
+		message := map[string]string{"text": rendered.String()}
+		if sender.settings.Channel != "" {
+			message["channel"] = sender.settings.Channel
+		}
+		return json.Marshal(message)
+	case sender.template != nil:
+		return rendered.Bytes(), nil
+	default:
+		return json.Marshal(event)
+	}
+}
+
+// Функция выполняет запрос к вебхуку, retry - ошибку имеет смысл повторить (сеть, 429, 5xx)
+// адрес вебхука может содержать токен, поэтому в ошибку он не попадает
+func (sender *webhookSender) send(payload []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", sender.settings.URL.Value(), bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("invalid webhook url %s", sender.settings.URL)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sender.httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return false, nil
+}
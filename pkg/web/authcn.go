@@ -1,41 +1,179 @@
-package web
-
-import (
-	"encoding/json"
-	"log"
-	"main/pkg/contain"
-	"net/http"
-)
-
-type MtlsSettings struct {
-	Enabled   bool     `json:"enabled"`
-	Key       string   `json:"key"`
-	Cert      string   `json:"cert"`
-	AllowedCN []string `json:"allowedCN"`
-}
-
-func AuthenticationCN(next http.Handler, mtlsSetting MtlsSettings) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
-			var commonName = r.TLS.VerifiedChains[0][0].Subject.CommonName // Получаем CN
-			if contain.ContainString(mtlsSetting.AllowedCN, commonName) {  // если CN прописал в конфиге - ОК
-				log.Printf("Authentification successful. CN: %s, Remote address: %s", commonName, r.RemoteAddr)
-				next.ServeHTTP(w, r) // если все ок - передаем запрос следующему обработчику
-			} else if len(mtlsSetting.AllowedCN) == 0 || !mtlsSetting.Enabled {
-				log.Printf("Mtls disable. Request without mtls successful. Remote address: %s", r.RemoteAddr)
-				next.ServeHTTP(w, r)
-			} else { // если CN не прописан в конфиге - возвращаем ошибку
-				log.Printf("Authentification failed - incorrect CN: %s, Remote address: %s", commonName, r.RemoteAddr)
-				w.WriteHeader(http.StatusForbidden)
-				w.Header().Set("Content-Type", "application/json")
-				response := make(map[string]string)
-				response["message"] = "Incorrect CN of the certificate"
-				jsonResponse, _ := json.Marshal(response)
-				w.Write(jsonResponse)
-			}
-		} else {
-			log.Printf("Mtls disable. Request without mtls successful. Remote address: %s", r.RemoteAddr)
-			next.ServeHTTP(w, r)
-		}
-	})
-}
+package web
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// AllowedCN - список допустимых CN (точное совпадение), AllowRules - правила по CN, SAN, SPIFFE ID и OU
+// если не задано ни одного правила, допускается любой клиент с сертификатом, прошедшим проверку tls
+// ClientAuth - режим запроса клиентского сертификата листенером (require, request, none)
+type MtlsSettings struct {
+	Enabled    bool        `json:"enabled"`
+	Key        string      `json:"key"`
+	Cert       string      `json:"cert"`
+	AllowedCN  []string    `json:"allowedCN"`
+	AllowRules []AllowRule `json:"allowRules"`
+	ClientAuth string      `json:"clientAuth"`
+}
+
+// Функция возвращает true, если листенер проверяет клиентские сертификаты (mtls включен и режим не none)
+func (mtlsSetting MtlsSettings) clientCertsChecked() bool {
+	return mtlsSetting.Enabled && mtlsSetting.ClientAuth != "none"
+}
+
+// Функция собирает все правила листенера: AllowedCN превращаются в правила точного совпадения CN
+func (mtlsSetting MtlsSettings) rules() []AllowRule {
+	var rules []AllowRule
+	for _, commonName := range mtlsSetting.AllowedCN {
+		rules = append(rules, AllowRule{CommonName: commonName})
+	}
+	return append(rules, mtlsSetting.AllowRules...)
+}
+
+// Функция проверяет правила листенера, вызывается до запуска сервера
+func (mtlsSetting MtlsSettings) Validate() error {
+	_, err := compileAllowRules(mtlsSetting.rules())
+	return err
+}
+
+// Проверка клиента по сертификату и, если заданы credentials, по паролю или токену
+// без credentials клиент без сертификата допускается, только если листенер не проверяет сертификаты (mtls выключен или clientAuth none),
+// иначе в режиме request клиент без сертификата прошел бы мимо правил; сертификат проверяется по правилам
+// с credentials достаточно подходящего сертификата или верного пароля/токена, при RequireCertificate нужны оба
+func AuthenticationCN(next http.Handler, mtlsSetting MtlsSettings, credentials *CredentialStore) http.Handler {
+	// правила проверяются в Validate до запуска сервера, при ошибке компиляции доступ по сертификату запрещается
+	rules, err := compileAllowRules(mtlsSetting.rules())
+	if err != nil {
+		slog.Error("Invalid allow rules, all certificate clients are denied", "error", err)
+	}
+	rulesBroken := err != nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cert *x509.Certificate // сертификат клиента
+		var certAllowed bool
+		var certReason string
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			cert = r.TLS.VerifiedChains[0][0]
+			if rule, ok := matchRules(rules, cert); ok { // если сертификат подходит под правило - ОК
+				certAllowed, certReason = true, "rule matched: "+rule.String()
+			} else if (len(rules) == 0 && !rulesBroken) || !mtlsSetting.Enabled {
+				certAllowed, certReason = true, "no allow rules configured"
+			} else {
+				certReason = "no allow rule matched"
+			}
+		}
+		if !credentials.Configured() {
+			switch {
+			case cert == nil && mtlsSetting.clientCertsChecked():
+				logAccess(r, nil, "", "", "deny", "no client certificate")
+				RejectedRequests.WithLabelValues(rejectUnauthorized).Inc()
+				WriteDenied(w, http.StatusUnauthorized, "A client certificate is required")
+			case cert == nil:
+				logAccess(r, nil, "", "", "allow", "mtls disabled or client certificates are not requested")
+				next.ServeHTTP(w, r)
+			case certAllowed:
+				logAccess(r, cert, "", "", "allow", certReason)
+				next.ServeHTTP(w, withIdentity(r, Identity{Cert: cert})) // если все ок - передаем запрос следующему обработчику
+			default: // если сертификат не подходит ни под одно правило - возвращаем ошибку
+				logAccess(r, cert, "", "", "deny", certReason)
+				RejectedRequests.WithLabelValues(rejectCertificateNotAllowed).Inc()
+				WriteDenied(w, http.StatusForbidden, "The client certificate is not allowed")
+			}
+			return
+		}
+		user, method, credentialsOK := credentials.Authenticate(r)
+		credentialsReason := "valid credentials"
+		if method == "" {
+			credentialsReason = "no credentials"
+		} else if !credentialsOK {
+			credentialsReason = "invalid credentials"
+		}
+		if cert == nil {
+			certReason = "no client certificate"
+		}
+		reason := certReason + ", " + credentialsReason
+		switch {
+		case credentials.settings.RequireCertificate && certAllowed && credentialsOK,
+			!credentials.settings.RequireCertificate && (certAllowed || credentialsOK):
+			logAccess(r, cert, method, user, "allow", reason)
+			identity := Identity{}
+			if certAllowed {
+				identity.Cert = cert
+			}
+			if credentialsOK {
+				identity.Method, identity.User = method, user
+			}
+			next.ServeHTTP(w, withIdentity(r, identity))
+		case cert != nil && !certAllowed:
+			logAccess(r, cert, method, user, "deny", reason)
+			RejectedRequests.WithLabelValues(rejectCertificateNotAllowed).Inc()
+			WriteDenied(w, http.StatusForbidden, "The client certificate is not allowed")
+		default:
+			logAccess(r, cert, method, user, "deny", reason)
+			RejectedRequests.WithLabelValues(rejectUnauthorized).Inc()
+			if len(credentials.settings.BasicAuthUsers) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="group-dns-exporter"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			WriteDenied(w, http.StatusUnauthorized, "Valid credentials are required")
+		}
+	})
+}
+
+// Функция сохраняет клиента в контексте запроса для авторизации в следующих обработчиках
+func withIdentity(r *http.Request, identity Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// Функция отвечает клиенту ошибкой в формате json
+func WriteDenied(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	response := make(map[string]string)
+	response["message"] = message
+	jsonResponse, _ := json.Marshal(response)
+	w.Write(jsonResponse)
+}
+
+// Функция возвращает первое правило, под которое подходит сертификат
+func matchRules(rules []compiledRule, cert *x509.Certificate) (AllowRule, bool) {
+	for _, rule := range rules {
+		if rule.matches(cert) {
+			return rule.source, true
+		}
+	}
+	return AllowRule{}, false
+}
+
+// Функция пишет решение о доступе в структурированный журнал
+// method и user - способ и имя при аутентификации по паролю или токену, пустые если заголовка не было
+func logAccess(r *http.Request, cert *x509.Certificate, method, user, decision, reason string) {
+	attrs := []any{
+		slog.String("decision", decision),
+		slog.String("reason", reason),
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("client_ip", ClientIP(r)),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+	}
+	if method != "" {
+		attrs = append(attrs, slog.String("auth_method", method), slog.String("user", user))
+	}
+	if cert != nil {
+		attrs = append(attrs,
+			slog.String("cn", cert.Subject.CommonName),
+			slog.Any("ou", cert.Subject.OrganizationalUnit),
+			slog.Any("dns_names", cert.DNSNames),
+			slog.Any("uris", certURIs(cert)),
+		)
+	}
+	if decision == "deny" {
+		slog.Warn("Access decision", attrs...)
+		return
+	}
+	slog.Info("Access decision", attrs...)
+}
@@ -0,0 +1,139 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Функция создает сертификат клиента с заданными CN, DNS SAN, URI SAN и OU
+func testClientCert(commonName string, dnsNames []string, uri string, units ...string) *x509.Certificate {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: commonName, OrganizationalUnit: units},
+		DNSNames: dnsNames,
+	}
+	if uri != "" {
+		parsed, _ := url.Parse(uri)
+		cert.URIs = []*url.URL{parsed}
+	}
+	return cert
+}
+
+// Функция выполняет запрос через AuthenticationCN, cert - проверенный tls сертификат клиента, nil - без сертификата
+func serveAuth(t *testing.T, mtls MtlsSettings, credentials *CredentialStore, cert *x509.Certificate, prepare func(*http.Request)) (int, Identity) {
+	t.Helper()
+	var identity Identity
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = IdentityFromContext(r.Context())
+	})
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	rec := httptest.NewRecorder()
+	AuthenticationCN(next, mtls, credentials).ServeHTTP(rec, req)
+	return rec.Code, identity
+}
+
+func TestAuthenticationCNMatchers(t *testing.T) {
+	spiffe := "spiffe://example.org/ns/monitoring/sa/prometheus"
+	prometheus := testClientCert("prometheus.monitoring", []string{"prometheus.monitoring.svc"}, spiffe, "monitoring", "noc")
+	other := testClientCert("grafana.web", []string{"grafana.web.svc"}, "spiffe://example.org/ns/web/sa/grafana", "web")
+	cases := []struct {
+		name string
+		mtls MtlsSettings
+		cert *x509.Certificate
+		want int
+	}{
+		{"allowedCN allow", MtlsSettings{AllowedCN: []string{"prometheus.monitoring"}}, prometheus, http.StatusOK},
+		{"allowedCN deny", MtlsSettings{AllowedCN: []string{"prometheus.monitoring"}}, other, http.StatusForbidden},
+		{"exact cn allow", MtlsSettings{AllowRules: []AllowRule{{CommonName: "prometheus.monitoring"}}}, prometheus, http.StatusOK},
+		{"exact cn is not a prefix match", MtlsSettings{AllowRules: []AllowRule{{CommonName: "prometheus"}}}, prometheus, http.StatusForbidden},
+		{"exact cn dot is literal", MtlsSettings{AllowRules: []AllowRule{{CommonName: "prometheus.monitoring", Match: "exact"}}}, testClientCert("prometheusXmonitoring", nil, ""), http.StatusForbidden},
+		{"glob cn allow", MtlsSettings{AllowRules: []AllowRule{{CommonName: "*.monitoring", Match: "glob"}}}, prometheus, http.StatusOK},
+		{"glob cn deny", MtlsSettings{AllowRules: []AllowRule{{CommonName: "*.monitoring", Match: "glob"}}}, other, http.StatusForbidden},
+		{"glob question mark", MtlsSettings{AllowRules: []AllowRule{{CommonName: "grafana.we?", Match: "glob"}}}, other, http.StatusOK},
+		{"regex cn allow", MtlsSettings{AllowRules: []AllowRule{{CommonName: `(prometheus|thanos)\.monitoring`, Match: "regex"}}}, prometheus, http.StatusOK},
+		{"regex cn is anchored", MtlsSettings{AllowRules: []AllowRule{{CommonName: `prometheus`, Match: "regex"}}}, prometheus, http.StatusForbidden},
+		{"dns san allow", MtlsSettings{AllowRules: []AllowRule{{DNSName: "prometheus.monitoring.svc"}}}, prometheus, http.StatusOK},
+		{"dns san glob deny", MtlsSettings{AllowRules: []AllowRule{{DNSName: "*.monitoring.svc", Match: "glob"}}}, other, http.StatusForbidden},
+		{"spiffe uri allow", MtlsSettings{AllowRules: []AllowRule{{URI: spiffe}}}, prometheus, http.StatusOK},
+		{"spiffe uri glob allow", MtlsSettings{AllowRules: []AllowRule{{URI: "spiffe://example.org/ns/monitoring/*", Match: "glob"}}}, prometheus, http.StatusOK},
+		{"spiffe uri glob deny", MtlsSettings{AllowRules: []AllowRule{{URI: "spiffe://example.org/ns/monitoring/*", Match: "glob"}}}, other, http.StatusForbidden},
+		{"spiffe uri regex deny other trust domain", MtlsSettings{AllowRules: []AllowRule{{URI: `spiffe://example\.org/.*`, Match: "regex"}}}, testClientCert("x", nil, "spiffe://evil.org/ns/monitoring/sa/prometheus"), http.StatusForbidden},
+		{"ou allow any of several", MtlsSettings{AllowRules: []AllowRule{{OrganizationalUnit: "noc"}}}, prometheus, http.StatusOK},
+		{"ou deny", MtlsSettings{AllowRules: []AllowRule{{OrganizationalUnit: "noc"}}}, other, http.StatusForbidden},
+		{"all fields of a rule must match", MtlsSettings{AllowRules: []AllowRule{{CommonName: "grafana.web", OrganizationalUnit: "noc"}}}, other, http.StatusForbidden},
+		{"rules are combined by or", MtlsSettings{AllowRules: []AllowRule{{CommonName: "nobody"}, {OrganizationalUnit: "web"}}}, other, http.StatusOK},
+		{"no rules allow any verified cert", MtlsSettings{}, other, http.StatusOK},
+		{"no cert with clientAuth request", MtlsSettings{ClientAuth: "request", AllowRules: []AllowRule{{CommonName: "prometheus.monitoring"}}}, nil, http.StatusUnauthorized},
+		{"no cert with clientAuth require", MtlsSettings{AllowedCN: []string{"prometheus.monitoring"}}, nil, http.StatusUnauthorized},
+		{"no cert with clientAuth none", MtlsSettings{ClientAuth: "none"}, nil, http.StatusOK},
+	}
+	for _, tc := range cases {
+		tc.mtls.Enabled = true
+		if err := tc.mtls.Validate(); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		code, identity := serveAuth(t, tc.mtls, nil, tc.cert, nil)
+		if code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, code, tc.want)
+		}
+		if code == http.StatusOK && identity.Cert != tc.cert {
+			t.Errorf("%s: the client certificate is not passed in the context", tc.name)
+		}
+	}
+}
+
+func TestAuthenticationCNMtlsDisabled(t *testing.T) {
+	if code, _ := serveAuth(t, MtlsSettings{AllowedCN: []string{"prometheus"}}, nil, nil, nil); code != http.StatusOK {
+		t.Errorf("without mtls and credentials: status = %d, want 200", code)
+	}
+}
+
+func TestAllowRuleValidation(t *testing.T) {
+	for _, rules := range [][]AllowRule{
+		{{}},
+		{{CommonName: "x", Match: "prefix"}},
+		{{CommonName: "(", Match: "regex"}},
+	} {
+		if err := (MtlsSettings{AllowRules: rules}).Validate(); err == nil {
+			t.Errorf("rules %+v must be rejected", rules)
+		}
+	}
+	// с некорректными правилами доступ по сертификату запрещается
+	code, _ := serveAuth(t, MtlsSettings{Enabled: true, AllowRules: []AllowRule{{CommonName: "(", Match: "regex"}}}, nil, testClientCert("(", nil, ""), nil)
+	if code != http.StatusForbidden {
+		t.Errorf("broken rules: status = %d, want 403", code)
+	}
+}
+
+func TestIdentityMatcher(t *testing.T) {
+	matcher, err := NewIdentityMatcher([]string{"alice"}, []AllowRule{{OrganizationalUnit: "noc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		identity Identity
+		want     bool
+	}{
+		{"user", Identity{User: "alice", Method: "basic"}, true},
+		{"other user", Identity{User: "bob", Method: "basic"}, false},
+		{"certificate", Identity{Cert: testClientCert("x", nil, "", "noc")}, true},
+		{"other certificate", Identity{Cert: testClientCert("x", nil, "", "web")}, false},
+		{"no identity", Identity{}, false},
+	}
+	for _, tc := range cases {
+		if got := matcher.Match(tc.identity); got != tc.want {
+			t.Errorf("%s: match = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
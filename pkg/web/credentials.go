@@ -0,0 +1,166 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Настройки аутентификации по паролю и токену
+// BasicAuthUsers - имя пользователя и bcrypt хеш пароля (как basic_auth_users в web-config exporter-toolkit)
+// BearerTokenFiles - имя клиента и путь к файлу со статическим токеном
+// RequireCertificate - требовать и сертификат, и пароль/токен; по умолчанию достаточно любого из способов
+type Credentials struct {
+	BasicAuthUsers     map[string]string `json:"basicAuthUsers"`
+	BearerTokenFiles   map[string]string `json:"bearerTokenFiles"`
+	RequireCertificate bool              `json:"requireCertificate"`
+}
+
+// Хранилище учетных данных, токены читаются из файлов при создании и перечитываются в Watch при изменении файлов
+type CredentialStore struct {
+	settings Credentials
+	tokensMu sync.RWMutex
+	tokens   map[string]string    // имя клиента -> токен
+	modTimes map[string]time.Time // имя клиента -> время изменения загруженного файла токена
+	// кеш успешных проверок bcrypt, проверка хеша на каждый запрос слишком дорогая
+	mu    sync.Mutex
+	cache map[string]bool
+}
+
+// хеш для выравнивания времени ответа при неизвестном пользователе
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Функция создает хранилище и загружает токены из файлов
+func NewCredentialStore(settings Credentials) (*CredentialStore, error) {
+	store := &CredentialStore{
+		settings: settings,
+		tokens:   make(map[string]string),
+		modTimes: make(map[string]time.Time),
+		cache:    make(map[string]bool),
+	}
+	for user, hash := range settings.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %s: %w", user, err)
+		}
+	}
+	for name, path := range settings.BearerTokenFiles {
+		token, modTime, err := readTokenFile(name, path)
+		if err != nil {
+			return nil, err
+		}
+		store.tokens[name] = token
+		store.modTimes[name] = modTime
+	}
+	return store, nil
+}
+
+// Функция читает файл токена, возвращает токен без пробельных символов и время изменения файла
+func readTokenFile(name, path string) (string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("read bearer token for %s: %w", name, err)
+	}
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("read bearer token for %s: %w", name, err)
+	}
+	if strings.TrimSpace(string(token)) == "" {
+		return "", time.Time{}, fmt.Errorf("bearer token file %s for %s is empty", path, name)
+	}
+	return strings.TrimSpace(string(token)), info.ModTime(), nil
+}
+
+// Функция проверяет файлы токенов с заданным интервалом и перечитывает их при изменении
+func (store *CredentialStore) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		store.reloadTokens()
+	}
+}
+
+// Функция перечитывает измененные файлы токенов
+// при ошибке чтения или пустом файле остается прежний токен, попытка повторится при следующей проверке
+func (store *CredentialStore) reloadTokens() {
+	for name, path := range store.settings.BearerTokenFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error checking the bearer token for %s: %s", name, err))
+			continue
+		}
+		store.tokensMu.RLock()
+		changed := !store.modTimes[name].Equal(info.ModTime())
+		store.tokensMu.RUnlock()
+		if !changed {
+			continue
+		}
+		token, modTime, err := readTokenFile(name, path)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error reloading the bearer token, the previous token is kept: %s", err))
+			continue
+		}
+		store.tokensMu.Lock()
+		store.tokens[name] = token
+		store.modTimes[name] = modTime
+		store.tokensMu.Unlock()
+		slog.Info(fmt.Sprintf("The bearer token for %s has been reloaded", name))
+	}
+}
+
+// Функция возвращает true, если задан хотя бы один пользователь или токен
+func (store *CredentialStore) Configured() bool {
+	return store != nil && (len(store.settings.BasicAuthUsers) > 0 || len(store.settings.BearerTokenFiles) > 0)
+}
+
+// Функция проверяет заголовок Authorization (Basic или Bearer)
+// возвращает имя пользователя или клиента токена, method - basic или bearer
+func (store *CredentialStore) Authenticate(r *http.Request) (name, method string, ok bool) {
+	if user, password, found := r.BasicAuth(); found {
+		return user, "basic", store.checkPassword(user, password)
+	}
+	authorization := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found {
+		return "", "", false
+	}
+	store.tokensMu.RLock()
+	defer store.tokensMu.RUnlock()
+	for name, expected := range store.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return name, "bearer", true
+		}
+	}
+	return "", "bearer", false
+}
+
+// Функция проверяет пароль по bcrypt хешу с кешированием успешных проверок
+func (store *CredentialStore) checkPassword(user, password string) bool {
+	hash, found := store.settings.BasicAuthUsers[user]
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	sum := sha256.Sum256([]byte(hash + ":" + password))
+	cacheKey := user + ":" + string(sum[:])
+	store.mu.Lock()
+	cached := store.cache[cacheKey]
+	store.mu.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	store.mu.Lock()
+	store.cache[cacheKey] = true
+	store.mu.Unlock()
+	return true
+}
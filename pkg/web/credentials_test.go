@@ -0,0 +1,141 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Функция создает bcrypt хеш с минимальной стоимостью, чтобы тесты не тратили время на хеширование
+func testHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// Функция записывает токен в файл и сдвигает время изменения, чтобы замена файла была заметна при грубой точности mtime
+func writeToken(t *testing.T, path, token string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func authenticate(store *CredentialStore, prepare func(*http.Request)) (string, string, bool) {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	prepare(req)
+	return store.Authenticate(req)
+}
+
+func TestCredentialStoreBasicAuth(t *testing.T) {
+	store, err := NewCredentialStore(Credentials{BasicAuthUsers: map[string]string{"prometheus": testHash(t, "secret")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		want     bool
+	}{
+		{"valid password", "prometheus", "secret", true},
+		{"valid password from the cache", "prometheus", "secret", true},
+		{"wrong password", "prometheus", "wrong", false},
+		{"unknown user", "nobody", "secret", false},
+		{"empty password", "prometheus", "", false},
+	}
+	for _, tc := range cases {
+		name, method, ok := authenticate(store, func(r *http.Request) { r.SetBasicAuth(tc.user, tc.password) })
+		if ok != tc.want || method != "basic" || name != tc.user {
+			t.Errorf("%s: name = %q, method = %q, ok = %v, want %v", tc.name, name, method, ok, tc.want)
+		}
+	}
+	if _, err := NewCredentialStore(Credentials{BasicAuthUsers: map[string]string{"prometheus": "secret"}}); err == nil {
+		t.Errorf("a plain text password must be rejected as an invalid bcrypt hash")
+	}
+}
+
+func TestCredentialStoreBearerToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	writeToken(t, tokenPath, "token-1\n", time.Now().Add(-time.Hour))
+	store, err := NewCredentialStore(Credentials{BearerTokenFiles: map[string]string{"grafana": tokenPath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Configured() {
+		t.Errorf("a store with a token file must be configured")
+	}
+	cases := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"valid token", "Bearer token-1", true},
+		{"wrong token", "Bearer token-2", false},
+		{"token prefix", "Bearer token-", false},
+		{"empty token", "Bearer ", false},
+		{"other scheme", "Token token-1", false},
+	}
+	for _, tc := range cases {
+		name, _, ok := authenticate(store, func(r *http.Request) { r.Header.Set("Authorization", tc.header) })
+		if ok != tc.want || (ok && name != "grafana") {
+			t.Errorf("%s: name = %q, ok = %v, want %v", tc.name, name, ok, tc.want)
+		}
+	}
+
+	emptyPath := filepath.Join(dir, "empty")
+	writeToken(t, emptyPath, " \n", time.Now())
+	for _, path := range []string{emptyPath, filepath.Join(dir, "missing")} {
+		if _, err := NewCredentialStore(Credentials{BearerTokenFiles: map[string]string{"grafana": path}}); err == nil {
+			t.Errorf("token file %s must be rejected", path)
+		}
+	}
+}
+
+func TestCredentialStoreTokenRotation(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	writeToken(t, tokenPath, "token-1", time.Now().Add(-time.Hour))
+	store, err := NewCredentialStore(Credentials{BearerTokenFiles: map[string]string{"grafana": tokenPath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func(token string) bool {
+		_, _, ok := authenticate(store, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) })
+		return ok
+	}
+
+	writeToken(t, tokenPath, "token-2", time.Now().Add(-time.Minute))
+	store.reloadTokens()
+	if valid("token-1") || !valid("token-2") {
+		t.Errorf("after rotation the new token must replace the old one")
+	}
+
+	// пустой или удаленный файл не сбрасывает загруженный токен
+	writeToken(t, tokenPath, "", time.Now())
+	store.reloadTokens()
+	if !valid("token-2") {
+		t.Errorf("an empty token file must keep the previous token")
+	}
+	os.Remove(tokenPath)
+	store.reloadTokens()
+	if !valid("token-2") {
+		t.Errorf("a missing token file must keep the previous token")
+	}
+	writeToken(t, tokenPath, "token-3", time.Now())
+	store.reloadTokens()
+	if !valid("token-3") {
+		t.Errorf("the token must be loaded again after the file is restored")
+	}
+}
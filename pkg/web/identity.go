@@ -0,0 +1,186 @@
+package web
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Правило допуска клиента по сертификату
+// все заданные в правиле поля должны совпасть, правила одного листенера объединяются по ИЛИ
+// Match - способ сравнения: exact (по умолчанию), glob (* и ?) или regex
+type AllowRule struct {
+	CommonName         string `json:"commonName"`
+	DNSName            string `json:"dnsName"`            // DNS SAN
+	URI                string `json:"uri"`                // URI SAN, например SPIFFE ID
+	OrganizationalUnit string `json:"organizationalUnit"` // OU субъекта
+	Match              string `json:"match"`
+}
+
+// Скомпилированное правило, пустой matcher - поле в правиле не задано
+type compiledRule struct {
+	source             AllowRule
+	commonName         *regexp.Regexp
+	dnsName            *regexp.Regexp
+	uri                *regexp.Regexp
+	organizationalUnit *regexp.Regexp
+}
+
+// Функция компилирует правила, ошибка - неизвестный способ сравнения, некорректное регулярное выражение или пустое правило
+func compileAllowRules(rules []AllowRule) ([]compiledRule, error) {
+	var compiled []compiledRule
+	for i, rule := range rules {
+		if rule.CommonName == "" && rule.DNSName == "" && rule.URI == "" && rule.OrganizationalUnit == "" {
+			return nil, fmt.Errorf("allow rule %d has no fields to match", i)
+		}
+		item := compiledRule{source: rule}
+		var err error
+		for _, field := range []struct {
+			pattern string
+			target  **regexp.Regexp
+		}{
+			{rule.CommonName, &item.commonName},
+			{rule.DNSName, &item.dnsName},
+			{rule.URI, &item.uri},
+			{rule.OrganizationalUnit, &item.organizationalUnit},
+		} {
+			if field.pattern == "" {
+				continue
+			}
+			if *field.target, err = compilePattern(field.pattern, rule.Match); err != nil {
+				return nil, fmt.Errorf("allow rule %d: %w", i, err)
+			}
+		}
+		compiled = append(compiled, item)
+	}
+	return compiled, nil
+}
+
+// Функция переводит шаблон в регулярное выражение, которое должно совпасть со строкой целиком
+func compilePattern(pattern, match string) (*regexp.Regexp, error) {
+	switch match {
+	case "", "exact":
+		return regexp.Compile("^" + regexp.QuoteMeta(pattern) + "$")
+	case "glob":
+		var expr strings.Builder
+		for _, char := range pattern {
+			switch char {
+			case '*':
+				expr.WriteString(".*")
+			case '?':
+				expr.WriteString(".")
+			default:
+				expr.WriteString(regexp.QuoteMeta(string(char)))
+			}
+		}
+		return regexp.Compile("^" + expr.String() + "$")
+	case "regex":
+		return regexp.Compile("^(?:" + pattern + ")$")
+	default:
+		return nil, fmt.Errorf("unknown match type %s", match)
+	}
+}
+
+// Функция проверяет сертификат клиента по правилу
+func (rule compiledRule) matches(cert *x509.Certificate) bool {
+	if rule.commonName != nil && !rule.commonName.MatchString(cert.Subject.CommonName) {
+		return false
+	}
+	if rule.dnsName != nil && !matchAny(rule.dnsName, cert.DNSNames) {
+		return false
+	}
+	if rule.uri != nil && !matchAny(rule.uri, certURIs(cert)) {
+		return false
+	}
+	if rule.organizationalUnit != nil && !matchAny(rule.organizationalUnit, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	return true
+}
+
+// Функция возвращает true, если выражение совпало хотя бы с одним значением
+func matchAny(expr *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if expr.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция возвращает URI SAN сертификата строками
+func certURIs(cert *x509.Certificate) []string {
+	var uris []string
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	return uris
+}
+
+// Функция описывает правило для журнала доступа
+func (rule AllowRule) String() string {
+	var parts []string
+	for _, field := range [][2]string{
+		{"cn", rule.CommonName},
+		{"dns", rule.DNSName},
+		{"uri", rule.URI},
+		{"ou", rule.OrganizationalUnit},
+	} {
+		if field[1] != "" {
+			parts = append(parts, field[0]+"="+field[1])
+		}
+	}
+	match := rule.Match
+	if match == "" {
+		match = "exact"
+	}
+	return fmt.Sprintf("%s(%s)", match, strings.Join(parts, ","))
+}
+
+// Клиент, прошедший аутентификацию: сертификат и/или имя пользователя basic auth или клиента bearer токена
+type Identity struct {
+	Cert   *x509.Certificate
+	Method string // basic, bearer или пустая строка
+	User   string
+}
+
+type identityKey struct{}
+
+// Функция возвращает клиента, сохраненного в контексте запроса AuthenticationCN
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// Сопоставление клиента с набором правил: по имени пользователя/токена или по сертификату
+type IdentityMatcher struct {
+	users map[string]bool
+	rules []compiledRule
+}
+
+// Функция создает IdentityMatcher, ошибка - некорректное правило по сертификату
+func NewIdentityMatcher(users []string, rules []AllowRule) (*IdentityMatcher, error) {
+	compiled, err := compileAllowRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	matcher := &IdentityMatcher{users: make(map[string]bool), rules: compiled}
+	for _, user := range users {
+		matcher.users[user] = true
+	}
+	return matcher, nil
+}
+
+// Функция возвращает true, если имя пользователя или сертификат клиента подходят под правила
+func (matcher *IdentityMatcher) Match(identity Identity) bool {
+	if identity.User != "" && matcher.users[identity.User] {
+		return true
+	}
+	if identity.Cert != nil {
+		_, ok := matchRules(matcher.rules, identity.Cert)
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Счетчик отклоненных запросов к экспортеру по причине
+var RejectedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_requests_rejected_total",
+		Help: "Количество отклоненных запросов к экспортеру по причине",
+	},
+	[]string{"reason"},
+)
+
+// Причины отклонения запроса
+const (
+	rejectIPDenied              = "ip_denied"
+	rejectIPNotAllowed          = "ip_not_allowed"
+	rejectInvalidRemoteAddr     = "invalid_remote_addr"
+	rejectCertificateNotAllowed = "certificate_not_allowed"
+	rejectUnauthorized          = "unauthorized"
+)
+
+// Настройки фильтрации по адресу клиента, элементы - подсети CIDR или отдельные адреса
+// Deny проверяется первым, если Allow не пустой - адрес должен входить в одну из подсетей
+// TrustedProxies - адреса прокси, от которых принимается заголовок X-Forwarded-For
+type IPFilterSettings struct {
+	Allow          []string `json:"allow"`
+	Deny           []string `json:"deny"`
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// Разобранные настройки фильтрации
+type IPFilter struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	trustedProxies []netip.Prefix
+}
+
+type clientIPKey struct{}
+
+// Функция разбирает подсети из настроек, ошибка - некорректная подсеть или адрес
+func NewIPFilter(settings IPFilterSettings) (*IPFilter, error) {
+	var filter IPFilter
+	var err error
+	if filter.allow, err = parsePrefixes(settings.Allow); err != nil {
+		return nil, fmt.Errorf("ip filter allow: %w", err)
+	}
+	if filter.deny, err = parsePrefixes(settings.Deny); err != nil {
+		return nil, fmt.Errorf("ip filter deny: %w", err)
+	}
+	if filter.trustedProxies, err = parsePrefixes(settings.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("ip filter trusted proxies: %w", err)
+	}
+	return &filter, nil
+}
+
+// Функция разбирает подсети, отдельный адрес превращается в подсеть из одного адреса
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR or address %s", value)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Функция возвращает true, если адрес входит хотя бы в одну подсеть
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция определяет адрес клиента: адрес соединения или, если соединение от доверенного прокси,
+// первый справа адрес из X-Forwarded-For, не являющийся доверенным прокси
+func (filter *IPFilter) clientIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr = addr.Unmap()
+	if !containsAddr(filter.trustedProxies, addr) {
+		return addr, nil
+	}
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For address %s", forwarded[i])
+		}
+		addr = hop.Unmap()
+		if !containsAddr(filter.trustedProxies, addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+// Функция проверяет адрес клиента по спискам, возвращает причину отклонения или пустую строку
+func (filter *IPFilter) check(addr netip.Addr) string {
+	if containsAddr(filter.deny, addr) {
+		return rejectIPDenied
+	}
+	if len(filter.allow) > 0 && !containsAddr(filter.allow, addr) {
+		return rejectIPNotAllowed
+	}
+	return ""
+}
+
+// Фильтрация запросов по адресу клиента, оборачивает весь mux экспортера
+func FilterIP(next http.Handler, filter *IPFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := filter.clientIP(r)
+		if err != nil {
+			RejectedRequests.WithLabelValues(rejectInvalidRemoteAddr).Inc()
+			slog.Warn("Access decision", "decision", "deny", "reason", rejectInvalidRemoteAddr, "remote_addr", r.RemoteAddr,
+				"method", r.Method, "path", r.URL.Path, "error", err)
+			WriteDenied(w, http.StatusForbidden, "The client address is not allowed")
+			return
+		}
+		if reason := filter.check(addr); reason != "" {
+			RejectedRequests.WithLabelValues(reason).Inc()
+			slog.Warn("Access decision", "decision", "deny", "reason", reason, "remote_addr", r.RemoteAddr,
+				"client_ip", addr.String(), "method", r.Method, "path", r.URL.Path)
+			WriteDenied(w, http.StatusForbidden, "The client address is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, addr)))
+	})
+}
+
+// Функция возвращает адрес клиента, определенный FilterIP, или адрес соединения
+func ClientIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
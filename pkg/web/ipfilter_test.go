@@ -0,0 +1,96 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilterIP(t *testing.T) {
+	filter, err := NewIPFilter(IPFilterSettings{
+		Allow:          []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:           []string{"10.0.0.13", "2001:db8:bad::/48"},
+		TrustedProxies: []string{"192.0.2.10", "192.0.2.11", "fd00::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       int
+		clientIP   string
+	}{
+		{"allowed peer", "10.1.2.3:40000", nil, http.StatusOK, "10.1.2.3"},
+		{"peer outside allow", "172.16.0.1:40000", nil, http.StatusForbidden, ""},
+		{"deny takes precedence over allow", "10.0.0.13:40000", nil, http.StatusForbidden, ""},
+		{"untrusted peer with xff is checked by its own address", "172.16.0.1:40000", []string{"10.1.2.3"}, http.StatusForbidden, ""},
+		{"untrusted peer cannot hide behind xff", "10.1.2.3:40000", []string{"10.0.0.13"}, http.StatusOK, "10.1.2.3"},
+		{"trusted proxy with xff", "192.0.2.10:40000", []string{"10.1.2.3"}, http.StatusOK, "10.1.2.3"},
+		{"trusted proxy without xff", "192.0.2.10:40000", nil, http.StatusForbidden, ""},
+		{"multi hop xff skips trusted proxies from the right", "192.0.2.10:40000", []string{"172.16.0.1, 10.1.2.3, 192.0.2.11"}, http.StatusOK, "10.1.2.3"},
+		{"multi hop xff in several headers", "192.0.2.10:40000", []string{"10.1.2.3", "192.0.2.11"}, http.StatusOK, "10.1.2.3"},
+		{"multi hop xff spoofed left part is ignored", "192.0.2.10:40000", []string{"10.1.2.3, 172.16.0.1"}, http.StatusForbidden, ""},
+		{"multi hop xff denied client", "192.0.2.10:40000", []string{"10.1.2.3, 10.0.0.13, 192.0.2.11"}, http.StatusForbidden, ""},
+		{"invalid xff from trusted proxy", "192.0.2.10:40000", []string{"not-an-ip"}, http.StatusForbidden, ""},
+		{"ipv6 peer allowed", "[2001:db8:1::5]:40000", nil, http.StatusOK, "2001:db8:1::5"},
+		{"ipv6 peer denied", "[2001:db8:bad::5]:40000", nil, http.StatusForbidden, ""},
+		{"ipv6 peer outside allow", "[2001:db9::5]:40000", nil, http.StatusForbidden, ""},
+		{"ipv6 trusted proxy with ipv4 client", "[fd00::1]:40000", []string{"10.1.2.3"}, http.StatusOK, "10.1.2.3"},
+		{"ipv4 mapped ipv6 peer", "[::ffff:10.1.2.3]:40000", nil, http.StatusOK, "10.1.2.3"},
+		{"ipv4 mapped ipv6 peer denied", "[::ffff:10.0.0.13]:40000", nil, http.StatusForbidden, ""},
+		{"invalid remote address", "unix-socket", nil, http.StatusForbidden, ""},
+	}
+	for _, tc := range cases {
+		var clientIP string
+		handler := FilterIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP = ClientIP(r)
+		}), filter)
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, header := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.want)
+		}
+		if clientIP != tc.clientIP {
+			t.Errorf("%s: client ip = %q, want %q", tc.name, clientIP, tc.clientIP)
+		}
+	}
+}
+
+func TestFilterIPWithoutAllow(t *testing.T) {
+	filter, err := NewIPFilter(IPFilterSettings{Deny: []string{"2001:db8::/32"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remoteAddr, want := range map[string]int{
+		"172.16.0.1:40000":    http.StatusOK,
+		"[2001:db9::1]:40000": http.StatusOK,
+		"[2001:db8::1]:40000": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		FilterIP(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), filter).ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", remoteAddr, rec.Code, want)
+		}
+	}
+}
+
+func TestNewIPFilterInvalid(t *testing.T) {
+	for _, settings := range []IPFilterSettings{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"example.com"}},
+		{TrustedProxies: []string{"192.0.2.1/"}},
+	} {
+		if _, err := NewIPFilter(settings); err == nil {
+			t.Errorf("settings %+v must be rejected", settings)
+		}
+	}
+}